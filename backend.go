@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+)
+
+// Backend is a source of machines and units for the ServiceRegistry
+type Backend interface {
+	Machines() ([]*Machine, error)
+	UnitStates() ([]*UnitState, error)
+	// UnitOptions returns the parsed unit file, nil if the unit doesn't exist
+	UnitOptions(unitName string) ([]*unit.UnitOption, error)
+}
+
+// WatchingBackend is a Backend that can report changes as they happen,
+// a nil event asks the registry for a full reload
+type WatchingBackend interface {
+	Backend
+	Watch(eventCh chan<- *BackendEvent, stopCh <-chan struct{})
+}
+
+type Machine struct {
+	ID       string
+	PublicIP string
+}
+
+type UnitState struct {
+	UnitName    string
+	MachineID   string
+	UnitHash    string
+	ActiveState string
+}
+
+// BackendEvent is a single change to either a machine or a unit state,
+// a removed UnitState without a MachineID removes the unit everywhere
+type BackendEvent struct {
+	Machine   *Machine
+	UnitState *UnitState
+	Removed   bool
+}
+
+// shortMachineId is the abbreviated machine ID, as used by fleet
+func shortMachineId(id string) string {
+	if len(id) <= 8 {
+		return id
+	}
+	return id[:8]
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ringVnodes is the number of points each replica gets on the hash ring,
+// enough to spread units evenly between a handful of replicas
+const ringVnodes = 64
+
+// HealthStore shares health check results between watchdns replicas, so
+// each unit is only checked by a few of them and all of them agree on it
+type HealthStore interface {
+	// Join announces the replica as alive for ttl
+	Join(replicaId string, ttl time.Duration) error
+	// Members returns every replica that is alive
+	Members() ([]string, error)
+	// Report records a replica's view of a unit for ttl
+	Report(unitId, replicaId string, online bool, ttl time.Duration) error
+	// Reports returns every unexpired report, by unit and then replica
+	Reports() (map[string]map[string]bool, error)
+}
+
+// clusterView is what the replicas agree on at one point in time
+type clusterView struct {
+	Members []string
+	Reports map[string]map[string]bool
+}
+
+type healthReport struct {
+	UnitId string
+	Online bool
+	Ttl    time.Duration
+}
+
+// hashRing assigns units to replicas by consistent hashing, so a replica
+// joining or leaving only moves the units next to it
+type hashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+func newHashRing(members []string) *hashRing {
+	h := &hashRing{make([]uint32, 0, len(members)*ringVnodes), make(map[uint32]string, len(members)*ringVnodes)}
+	for _, m := range members {
+		for i := 0; i < ringVnodes; i++ {
+			p := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(i)))
+			if _, ok := h.members[p]; ok {
+				continue
+			}
+			h.members[p] = m
+			h.points = append(h.points, p)
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+	return h
+}
+
+// owners returns the n distinct replicas responsible for key
+func (h *hashRing) owners(key string, n int) []string {
+	if len(h.points) == 0 {
+		return nil
+	}
+	owners := make([]string, 0, n)
+	k := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= k })
+	for i := 0; i < len(h.points) && len(owners) < n; i++ {
+		m := h.members[h.points[(start+i)%len(h.points)]]
+		found := false
+		for _, o := range owners {
+			found = found || o == m
+		}
+		if !found {
+			owners = append(owners, m)
+		}
+	}
+	return owners
+}
+
+// SetHealthStore makes the registry share health checking with other
+// replicas through store, it must be called before Start
+func (r *ServiceRegistry) SetHealthStore(store HealthStore) {
+	r.store = store
+	r.reports = make(map[string]healthReport)
+	r.reportCh = make(chan struct{}, 1)
+}
+
+// ownsUnit reports whether this replica should health check the unit, every
+// replica checks everything until it has a view of the cluster, and units
+// nobody has reported on yet
+func (r *ServiceRegistry) ownsUnit(unitId string) bool {
+	if r.ring == nil || len(r.reported[unitId]) == 0 {
+		return true
+	}
+	for _, o := range r.ring.owners(unitId, r.Options.CheckReplicas) {
+		if o == r.Options.ReplicaId {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCheckedHealth serves the outcome of this replica's own checks
+// (CheckedOnline), unless the cluster view decides what is served (Online)
+// so every replica gives the same answers
+func (r *ServiceRegistry) serveCheckedHealth(entry *ServiceEntry) {
+	if r.store != nil && r.ring != nil {
+		return
+	}
+	if entry.Online != entry.CheckedOnline {
+		entry.Online = entry.CheckedOnline
+		r.dirty = true
+	}
+}
+
+// reportHealth queues the outcome of a round of checks for the other replicas,
+// only the latest one per unit is kept until it's sent
+func (r *ServiceRegistry) reportHealth(unitId string, entry *ServiceEntry) {
+	if r.store == nil {
+		return
+	}
+	r.reportLock.Lock()
+	r.reports[unitId] = healthReport{unitId, entry.CheckedOnline, 3 * entry.CheckInterval}
+	r.reportLock.Unlock()
+	select {
+	case r.reportCh <- struct{}{}:
+	default:
+		//syncCluster is already due to send the queue
+	}
+}
+
+// syncCluster sends reports to the store and reads back the cluster view
+// every SyncInterval, it runs outside of the main loop as the store is slow
+func (r *ServiceRegistry) syncCluster(viewCh chan<- *clusterView, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(r.Options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case viewCh <- r.readClusterView():
+		case <-stopCh:
+			return
+		}
+	wait:
+		for {
+			select {
+			case <-r.reportCh:
+				r.sendReports()
+			case <-ticker.C:
+				break wait
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
+
+// sendReports sends every queued report to the store
+func (r *ServiceRegistry) sendReports() {
+	r.reportLock.Lock()
+	reports := r.reports
+	r.reports = make(map[string]healthReport, len(reports))
+	r.reportLock.Unlock()
+	for _, rep := range reports {
+		if err := r.store.Report(rep.UnitId, r.Options.ReplicaId, rep.Online, rep.Ttl); err != nil {
+			log.Warnf("Failed to report health of %s: %s\n", rep.UnitId, err.Error())
+		}
+	}
+}
+
+// readClusterView returns nil when the store can't be reached
+func (r *ServiceRegistry) readClusterView() *clusterView {
+	if err := r.store.Join(r.Options.ReplicaId, 3*r.Options.SyncInterval); err != nil {
+		log.Warnf("Failed to join health checking cluster: %s\n", err.Error())
+		return nil
+	}
+	members, err := r.store.Members()
+	if err != nil {
+		log.Warnf("Failed to read health checking cluster members: %s\n", err.Error())
+		return nil
+	}
+	reports, err := r.store.Reports()
+	if err != nil {
+		log.Warnf("Failed to read health reports: %s\n", err.Error())
+		return nil
+	}
+	return &clusterView{members, reports}
+}
+
+// applyClusterView takes the health of units from the reports of the
+// replicas checking them. A unit is online when at least half of the reports
+// of its owners say so; every replica reads the same reports, so they all
+// agree. Units without such reports keep their state until some arrive.
+func (r *ServiceRegistry) applyClusterView(v *clusterView) {
+	if v == nil {
+		//check everything ourselves until the store is back
+		r.ring = nil
+		r.reported = nil
+		return
+	}
+	r.ring = newHashRing(v.Members)
+	r.reported = v.Reports
+	for id, entry := range r.units {
+		reports := v.Reports[id]
+		if len(reports) == 0 || entry.healthCheckCount() == 0 || !entry.RemovedAt.IsZero() {
+			continue
+		}
+		//reports from replicas that no longer own the unit are stale until
+		//they expire, only the owners vote
+		votes, passed := 0, 0
+		for _, o := range r.ring.owners(id, r.Options.CheckReplicas) {
+			if online, ok := reports[o]; ok {
+				votes++
+				if online {
+					passed++
+				}
+			}
+		}
+		if votes == 0 {
+			continue
+		}
+		online := passed*2 >= votes
+		if online != entry.Online {
+			if online {
+				log.Info("Unit passed health check on other replicas:", id)
+			} else {
+				log.Info("Unit failed health check on other replicas:", id)
+			}
+			entry.Online = online
+			r.dirty = true
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a HealthStore shared by registries in the same process
+type memoryStore struct {
+	sync.Mutex
+	members map[string]time.Time
+	reports map[string]map[string]bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{members: make(map[string]time.Time), reports: make(map[string]map[string]bool)}
+}
+
+func (s *memoryStore) Join(replicaId string, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	s.members[replicaId] = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *memoryStore) Members() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	var members []string
+	for m, expires := range s.members {
+		if time.Now().Before(expires) {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+func (s *memoryStore) Report(unitId, replicaId string, online bool, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.reports[unitId] == nil {
+		s.reports[unitId] = make(map[string]bool)
+	}
+	s.reports[unitId][replicaId] = online
+	return nil
+}
+
+func (s *memoryStore) Reports() (map[string]map[string]bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	reports := make(map[string]map[string]bool, len(s.reports))
+	for u, rs := range s.reports {
+		reports[u] = make(map[string]bool, len(rs))
+		for m, online := range rs {
+			reports[u][m] = online
+		}
+	}
+	return reports, nil
+}
+
+// leave drops a replica as if its membership expired
+func (s *memoryStore) leave(replicaId string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.members, replicaId)
+	for _, rs := range s.reports {
+		delete(rs, replicaId)
+	}
+}
+
+func TestHashRing_Owners(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"})
+	counts := make(map[string]int)
+	before := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("web@%d.service:abcdef", i)
+		owners := ring.owners(key, 2)
+		assert.Len(t, owners, 2)
+		assert.NotEqual(t, owners[0], owners[1])
+		counts[owners[0]]++
+		before[key] = owners[0]
+	}
+	for m, n := range counts {
+		assert.True(t, n > 50, "%s owns too few units: %d", m, n)
+	}
+	assert.Equal(t, []string{"a"}, newHashRing([]string{"a"}).owners("x", 2))
+	assert.Nil(t, newHashRing(nil).owners("x", 2))
+
+	//only the units of the replica that left move
+	ring = newHashRing([]string{"a", "c"})
+	for key, owner := range before {
+		if owner != "b" {
+			assert.Equal(t, owner, ring.owners(key, 1)[0], key)
+		}
+	}
+}
+
+func newClusterRegistries(t *testing.T, store HealthStore, n int) []*ServiceRegistry {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	b := &fakeBackend{machines: []*Machine{{"abcdef0123456789", "127.0.0.1"}}, units: make(map[string][]*unit.UnitOption)}
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("web@%d.service", i)
+		b.states = append(b.states, &UnitState{name, "abcdef0123456789", "h1", "active"})
+		//odd units fail their check
+		addr := l.Addr().String()
+		if i%2 == 1 {
+			addr = closed.Addr().String()
+		}
+		b.units[name] = []*unit.UnitOption{unit.NewUnitOption("X-Watchdns", "CheckTcp", addr)}
+	}
+
+	rs := make([]*ServiceRegistry, n)
+	for i := range rs {
+		r := newTestRegistry()
+		r.backend = b
+		r.hRateCh = make(chan bool, 4)
+		r.Options.ReplicaId = fmt.Sprintf("replica-%d", i)
+		r.Options.CheckReplicas = 2
+		r.Options.SyncInterval = time.Minute
+		r.SetHealthStore(store)
+		r.reloadBackend()
+		rs[i] = r
+	}
+	return rs
+}
+
+// syncRegistries runs what the main loops would: every replica joins and
+// reads the view, checks what it owns and reports back
+func syncRegistries(rs []*ServiceRegistry) map[string]int {
+	for _, r := range rs {
+		r.store.Join(r.Options.ReplicaId, time.Minute)
+	}
+	for _, r := range rs {
+		r.applyClusterView(r.readClusterView())
+	}
+	checkedBy := make(map[string]int)
+	for _, r := range rs {
+		resultCh := make(chan HealthCheckResult, 100)
+		for _, e := range r.units {
+			e.LastHealthCheck = time.Time{}
+		}
+		r.doHealthChecks(resultCh)
+		checks := 0
+		for id, e := range r.units {
+			if e.PendingHealthChecks > 0 {
+				checkedBy[id]++
+				checks += e.PendingHealthChecks
+			}
+		}
+		for i := 0; i < checks; i++ {
+			r.processHealthCheckResult(<-resultCh)
+		}
+		r.sendReports()
+	}
+	for _, r := range rs {
+		r.applyClusterView(r.readClusterView())
+		r.publish()
+	}
+	return checkedBy
+}
+
+func TestDistributedHealthChecks(t *testing.T) {
+	store := newMemoryStore()
+	rs := newClusterRegistries(t, store, 3)
+
+	//nobody reported on the units yet, so every replica checks them
+	checkedBy := syncRegistries(rs)
+	assert.Len(t, checkedBy, 12)
+	for id, n := range checkedBy {
+		assert.Equal(t, 3, n, "%s should be checked by every replica", id)
+	}
+
+	checkedBy = syncRegistries(rs)
+	assert.Len(t, checkedBy, 12)
+	for id, n := range checkedBy {
+		assert.Equal(t, 2, n, "%s should be checked by 2 replicas", id)
+	}
+	for _, r := range rs {
+		assert.Len(t, r.LookupA("web.service.watchdns."), 6, r.Options.ReplicaId)
+		for i := 0; i < 12; i++ {
+			assert.Equal(t, i%2 == 0, len(r.LookupA(fmt.Sprintf("i-%d.web.service.watchdns.", i))) == 1, "%s: unit %d", r.Options.ReplicaId, i)
+		}
+	}
+
+	//the remaining replicas take over the units of one that went away
+	store.leave("replica-2")
+	checkedBy = syncRegistries(rs[:2])
+	assert.Len(t, checkedBy, 12)
+	for id, n := range checkedBy {
+		assert.Equal(t, 2, n, "%s should be checked by both remaining replicas", id)
+	}
+	for _, r := range rs[:2] {
+		assert.Len(t, r.LookupA("web.service.watchdns."), 6)
+	}
+}
+
+func TestApplyClusterView(t *testing.T) {
+	e := testEntry("web", "10.0.0.1", true)
+	e.CheckTcp = []*net.TCPAddr{{IP: net.ParseIP("10.0.0.1"), Port: 80}}
+	r := newTestRegistry(e)
+	r.Options.ReplicaId = "a"
+	r.Options.CheckReplicas = 1
+
+	r.applyClusterView(&clusterView{[]string{"b"}, map[string]map[string]bool{"a": {"b": false}}})
+	assert.False(t, r.ownsUnit("a"))
+	assert.False(t, e.Online)
+	assert.True(t, r.dirty)
+
+	//units nobody reported on are checked locally
+	r.applyClusterView(&clusterView{[]string{"b"}, map[string]map[string]bool{}})
+	assert.True(t, r.ownsUnit("a"))
+	assert.False(t, e.Online)
+
+	//ties count as online
+	r.Options.CheckReplicas = 2
+	r.applyClusterView(&clusterView{[]string{"a", "b"}, map[string]map[string]bool{"a": {"a": true, "b": false}}})
+	assert.True(t, e.Online)
+
+	//without a store every unit is checked locally
+	r.applyClusterView(nil)
+	assert.True(t, r.ownsUnit("a"))
+
+	//a replica that stopped owning the unit doesn't outvote its owner
+	r.applyClusterView(&clusterView{[]string{"b"}, map[string]map[string]bool{"a": {"b": false}}})
+	assert.False(t, e.Online)
+	r.applyClusterView(&clusterView{[]string{"b"}, map[string]map[string]bool{"a": {"a": false, "b": true, "c": false}}})
+	assert.True(t, e.Online)
+}
+
+func TestClusterViewIsServed(t *testing.T) {
+	store := newMemoryStore()
+	e := testEntry("web", "10.0.0.1", false)
+	e.CheckTcp = []*net.TCPAddr{{IP: net.ParseIP("10.0.0.1"), Port: 80}}
+	e.UnhealthyThreshold = 1
+	r := newTestRegistry(e)
+	r.Options.ReplicaId = "r1"
+	r.Options.CheckReplicas = 2
+	r.SetHealthStore(store)
+
+	r.applyClusterView(&clusterView{[]string{"r1", "r2"}, map[string]map[string]bool{"a": {"r1": true, "r2": false}}})
+	assert.True(t, e.Online)
+
+	//a failed local round is only reported, the replicas keep serving the view
+	e.CheckedOnline = true
+	e.PendingHealthChecks = 1
+	r.dirty = false
+	r.processHealthCheckResult(HealthCheckResult{"a", e.CheckRound, false})
+	assert.False(t, e.CheckedOnline)
+	assert.True(t, e.Online)
+	assert.False(t, r.dirty)
+	r.sendReports()
+	reports, _ := store.Reports()
+	assert.Equal(t, map[string]bool{"r1": false}, reports["a"])
+
+	//the replica's own opinion is reported, not the one it serves
+	store.reports = make(map[string]map[string]bool)
+	e.UnhealthyThreshold = 2
+	e.FailedRounds = 0
+	e.PendingHealthChecks = 1
+	e.FailedHealthChecks = 0
+	r.processHealthCheckResult(HealthCheckResult{"a", e.CheckRound, false})
+	r.sendReports()
+	reports, _ = store.Reports()
+	assert.Equal(t, map[string]bool{"r1": false}, reports["a"])
+
+	//without a view the local checks are served
+	r.applyClusterView(nil)
+	e.PendingHealthChecks = 1
+	e.FailedHealthChecks = 0
+	r.processHealthCheckResult(HealthCheckResult{"a", e.CheckRound, false})
+	assert.False(t, e.Online)
+}
+
+func TestReportHealth(t *testing.T) {
+	store := newMemoryStore()
+	e := testEntry("web", "10.0.0.1", true)
+	r := newTestRegistry(e)
+	r.Options.ReplicaId = "a"
+	r.SetHealthStore(store)
+
+	//reports are never dropped, only replaced by newer ones for the same unit
+	for i := 0; i < 500; i++ {
+		e.CheckedOnline = i%2 == 0
+		r.reportHealth(fmt.Sprintf("u%d", i%200), e)
+	}
+	assert.Len(t, r.reportCh, 1)
+	r.sendReports()
+	reports, _ := store.Reports()
+	assert.Len(t, reports, 200)
+	assert.Equal(t, map[string]bool{"a": false}, reports["u199"])
+	assert.Equal(t, map[string]bool{"a": true}, reports["u100"])
+	assert.Len(t, r.reports, 0)
+}
@@ -4,44 +4,220 @@ import (
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
+	"net"
 	"strings"
+	"time"
 )
 
 type dnsServer struct {
-	registry    *ServiceRegistry
-	shiftCounts map[string]int
+	registry  *ServiceRegistry
+	forwarder *Forwarder
+	rotator   *rotator
 }
 
-func serveDns(r *ServiceRegistry, bindAddr string) {
+// newDnsServer creates the handler for both listeners, forwarder
+// may be nil to refuse queries outside of the watch domain
+func newDnsServer(r *ServiceRegistry, forwarder *Forwarder) *dnsServer {
+	return &dnsServer{r, forwarder, new(rotator)}
+}
+
+// serveDns answers queries on both UDP and TCP using a single handler,
+// so clients that get a truncated UDP response can retry over TCP
+func serveDns(r *ServiceRegistry, bindAddr string, forwarder *Forwarder) {
 	log.Info("Starting dns server", bindAddr)
-	dns.ListenAndServe(bindAddr, "udp", &dnsServer{r, make(map[string]int)})
+	handler := newDnsServer(r, forwarder)
+	errCh := make(chan error, 2)
+	for _, proto := range []string{"udp", "tcp"} {
+		go func(proto string) {
+			errCh <- dns.ListenAndServe(bindAddr, proto, handler)
+		}(proto)
+	}
+	log.Fatalln("DNS server failed:", <-errCh)
+}
+
+// maxUdpSize returns the largest response the client can accept over UDP,
+// taking the advertised EDNS0 buffer size into account
+func maxUdpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// addressRR builds an A record for IPv4 addresses and an AAAA record
+// for everything else
+func addressRR(name string, ip net.IP, ttl time.Duration) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		a := new(dns.A)
+		a.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl.Seconds())}
+		a.A = ip4
+		return a
+	}
+	aaaa := new(dns.AAAA)
+	aaaa.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(ttl.Seconds())}
+	aaaa.AAAA = ip
+	return aaaa
+}
+
+// soa synthesizes the SOA record for the watch domain, the CheckInterval
+// doubles as the negative caching TTL
+func (d *dnsServer) soa() *dns.SOA {
+	domain := d.registry.Options.Domain
+	ttl := uint32(d.registry.Options.CheckInterval.Seconds())
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + domain,
+		Mbox:    "hostmaster." + domain,
+		Serial:  uint32(time.Now().Unix()), //the zone is synthesized, there are no secondaries to track it
+		Refresh: ttl,
+		Retry:   ttl,
+		Expire:  ttl,
+		Minttl:  ttl,
+	}
+}
+
+// forward relays a query outside of the watch domain to the upstream resolvers
+func (d *dnsServer) forward(w dns.ResponseWriter, r *dns.Msg) {
+	m, err := d.forwarder.Forward(r)
+	if err != nil {
+		log.Warn("Failed to forward query:", err)
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+	}
+	m.Id = r.Id
+	d.writeMsg(w, r, m)
+}
+
+// writeMsg sends the response, truncating it to what the client can accept
+func (d *dnsServer) writeMsg(w dns.ResponseWriter, r, m *dns.Msg) {
+	//UDP responses that don't fit get the TC bit so resolvers retry over TCP
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(maxUdpSize(r))
+	} else {
+		m.Truncate(dns.MaxMsgSize)
+	}
+	w.WriteMsg(m)
+}
+
+// inZone reports whether the question is ours to answer, which besides the
+// watch domain includes PTR queries for the addresses of known machines
+func (d *dnsServer) inZone(q dns.Question) bool {
+	if dns.IsSubDomain(d.registry.Options.Domain, q.Name) {
+		return true
+	}
+	return q.Qtype == dns.TypePTR && len(d.registry.LookupPtr(q.Name)) > 0
+}
+
+// sortAnswers orders the answers to a single question according to
+// RecordSort and returns at most max of them, 0 returns all of them.
+// Weighted answers are ordered before they are turned into records.
+func (d *dnsServer) sortAnswers(q dns.Question, rrs []dns.RR, max int) []dns.RR {
+	n := len(rrs)
+	if max > 0 && max < n {
+		n = max
+	}
+	if n == 0 {
+		return rrs
+	}
+	switch d.registry.Options.RecordSort {
+	case "random":
+		//a random sample when there are more than max
+		tmp := make([]dns.RR, n)
+		for i, v := range rand.Perm(len(rrs))[:n] {
+			tmp[i] = rrs[v]
+		}
+		return tmp
+	case "roundrobin":
+		//a window of max answers, moving by one every query
+		tmp := make([]dns.RR, n)
+		shift := d.rotator.next(strings.ToLower(q.Name), q.Qtype, len(rrs))
+		for i := range tmp {
+			tmp[i] = rrs[(i+shift)%len(rrs)]
+		}
+		return tmp
+	}
+	return rrs[:n]
 }
 
 func (d *dnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if d.forwarder != nil && len(r.Question) > 0 && !d.inZone(r.Question[0]) {
+		log.Debugln("Forwarding", r.Question[0].String())
+		d.forward(w, r)
+		return
+	}
 	m := new(dns.Msg)
 	m.SetReply(r)
+	m.Authoritative = true
 	m.Answer = make([]dns.RR, 0, len(r.Question)*3)
 	m.Extra = make([]dns.RR, 0, len(r.Question)*3)
 	for _, q := range r.Question {
 		log.Debugln("Query", q.String())
+		if !d.inZone(q) {
+			log.Debugln("Refusing out of zone query", q.Name)
+			m.Rcode = dns.RcodeRefused
+			m.Authoritative = false
+			continue
+		}
+		//lookups ignore case, answers echo the name as it was asked
+		name := strings.ToLower(q.Name)
+		if alias := d.registry.LookupAlias(name); alias.Target != "" {
+			cname := new(dns.CNAME)
+			cname.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(alias.Ttl.Seconds())}
+			cname.Target = alias.Target
+			m.Answer = append(m.Answer, cname)
+			//answer for the target as well, so clients don't have to chase it
+			q.Name = alias.Target
+			name = strings.ToLower(alias.Target)
+		}
 		switch q.Qtype {
-		case dns.TypeA:
-			ans := d.registry.LookupA(q.Name)
-			log.Debugln("Answer[A]", ans)
+		case dns.TypePTR:
+			ans := d.registry.LookupPtr(name)
+			log.Debugln("Answer[PTR]", ans)
 			for _, rec := range ans {
-				a := new(dns.A)
-				a.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(rec.Ttl.Seconds())}
-				a.A = rec.Server
-				m.Answer = append(m.Answer, a)
+				ptr := new(dns.PTR)
+				ptr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(rec.Ttl.Seconds())}
+				ptr.Ptr = rec.Target
+				m.Answer = append(m.Answer, ptr)
 			}
+		case dns.TypeTXT:
+			ans := d.registry.LookupTxt(name)
+			log.Debugln("Answer[TXT]", ans)
+			for _, rec := range ans {
+				txt := new(dns.TXT)
+				txt.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(rec.Ttl.Seconds())}
+				txt.Txt = rec.Txt
+				m.Answer = append(m.Answer, txt)
+			}
+		case dns.TypeSOA:
+			if dns.CountLabel(q.Name) == dns.CountLabel(d.registry.Options.Domain) {
+				m.Answer = append(m.Answer, d.soa())
+			}
+		case dns.TypeA, dns.TypeAAAA:
+			ans := d.registry.LookupA(name)
+			if d.registry.Options.RecordSort == "weighted" {
+				ans = weightedA(ans)
+			}
+			log.Debugln("Answer["+dns.TypeToString[q.Qtype]+"]", ans)
+			rrs := make([]dns.RR, 0, len(ans))
+			for _, rec := range ans {
+				//only answer with addresses from the requested family
+				if rr := addressRR(q.Name, rec.Server, rec.Ttl); rr.Header().Rrtype == q.Qtype {
+					rrs = append(rrs, rr)
+				}
+			}
+			m.Answer = append(m.Answer, d.sortAnswers(q, rrs, d.registry.LookupMaxAnswers(name))...)
 		case dns.TypeSRV:
-			parts := strings.SplitN(q.Name, ".", 3)
+			parts := strings.SplitN(name, ".", 3)
 			if len(parts) != 3 || len(parts[0]) < 2 || len(parts[1]) < 2 || parts[0][0] != '_' || parts[1][0] != '_' {
 				log.Warn("Invalid SRV request:", q.Name)
 				continue
 			}
-			ans := d.registry.LookupSrv(q.Name, parts[0][1:], parts[1][1:])
+			ans := d.registry.LookupSrv(name, parts[0][1:], parts[1][1:])
+			if d.registry.Options.RecordSort == "weighted" {
+				ans = weightedSrv(ans)
+			}
 			log.Debugln("Answer[SRV]", ans)
+			rrs := make([]dns.RR, 0, len(ans))
 			for _, rec := range ans {
 				srv := new(dns.SRV)
 				srv.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: uint32(rec.Ttl.Seconds())}
@@ -49,32 +225,19 @@ func (d *dnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 				srv.Priority = rec.Priority
 				srv.Target = rec.Target
 				srv.Weight = rec.Weight
-				m.Answer = append(m.Answer, srv)
+				rrs = append(rrs, srv)
 
-				a := new(dns.A)
-				a.Hdr = dns.RR_Header{Name: rec.Target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(rec.Ttl.Seconds())}
-				a.A = rec.TargetIP
-				m.Extra = append(m.Extra, a)
+				m.Extra = append(m.Extra, addressRR(rec.Target, rec.TargetIP, rec.Ttl))
 			}
+			m.Answer = append(m.Answer, d.sortAnswers(q, rrs, 0)...)
 		}
 	}
-	if len(m.Answer) > 0 {
-		if d.registry.Options.RecordSort == "random" {
-			tmp := make([]dns.RR, len(m.Answer))
-			p := rand.Perm(len(m.Answer))
-			for i, v := range p {
-				tmp[i] = m.Answer[v]
-			}
-			m.Answer = tmp
-		} else if d.registry.Options.RecordSort == "roundrobin" {
-			tmp := make([]dns.RR, len(m.Answer))
-			shift := d.shiftCounts[r.Question[0].Name]
-			d.shiftCounts[r.Question[0].Name] = (shift + 1) % len(m.Answer)
-			for i := range m.Answer {
-				tmp[i] = m.Answer[(i+shift)%len(m.Answer)]
-			}
-			m.Answer = tmp
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 && len(r.Question) > 0 {
+		//negative answers carry the SOA so resolvers can cache them
+		m.Ns = append(m.Ns, d.soa())
+		if !d.registry.LookupName(r.Question[0].Name) {
+			m.Rcode = dns.RcodeNameError
 		}
 	}
-	w.WriteMsg(m)
+	d.writeMsg(w, r, m)
 }
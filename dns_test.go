@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// newTestRegistry builds a registry with the given entries indexed
+// and published, without a backend
+func newTestRegistry(entries ...*ServiceEntry) *ServiceRegistry {
+	r := new(ServiceRegistry)
+	r.Options = RegistryOptions{Domain: "watchdns.", CheckInterval: 5 * time.Second, RecordSort: "default"}
+	r.units = make(map[string]*ServiceEntry)
+	r.lookup = make(map[string][]*ServiceEntry)
+	r.aliases = make(map[string][]*ServiceEntry)
+	r.machineLookup = make(map[string]net.IP)
+	r.names = make(map[string]int)
+	r.machineIps = make(map[string]string)
+	r.addName(r.Options.Domain)
+	for i, e := range entries {
+		r.units[string(rune('a'+i))] = e
+		r.indexEntry(e)
+	}
+	r.publish()
+	return r
+}
+
+func testEntry(name string, ip string, online bool) *ServiceEntry {
+	e := new(ServiceEntry)
+	e.Name = name
+	e.CheckInterval = 5 * time.Second
+	e.Hostname = "m-" + name + ".machine.watchdns."
+	e.ServerAddress = net.ParseIP(ip)
+	e.Running = true
+	e.Online = online
+	return e
+}
+
+func query(d *dnsServer, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	d.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestMaxUdpSize(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.MinMsgSize, maxUdpSize(m))
+	m.SetEdns0(4096, false)
+	assert.Equal(t, 4096, maxUdpSize(m))
+	m = new(dns.Msg)
+	m.SetEdns0(100, false)
+	assert.Equal(t, dns.MinMsgSize, maxUdpSize(m), "sizes below 512 are treated as 512")
+}
+
+func TestDnsServer_Truncate(t *testing.T) {
+	entries := make([]*ServiceEntry, 0, 50)
+	for i := 0; i < 50; i++ {
+		e := testEntry("big", "10.0.0.1", true)
+		e.SrvOptions = []*SrvOption{{Service: "xmpp", Protocol: "tcp", Port: 4000}}
+		e.Hostname = "m-" + string(rune('a'+i%26)) + string(rune('a'+i/26)) + ".machine.watchdns."
+		entries = append(entries, e)
+	}
+	d := newDnsServer(newTestRegistry(entries...), nil)
+	m := query(d, "_xmpp._tcp.watchdns.", dns.TypeSRV)
+	assert.True(t, m.Truncated)
+	assert.True(t, m.Len() <= dns.MinMsgSize)
+
+	req := new(dns.Msg)
+	req.SetQuestion("_xmpp._tcp.watchdns.", dns.TypeSRV)
+	w := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	d.ServeDNS(w, req)
+	assert.False(t, w.msg.Truncated)
+	assert.Len(t, w.msg.Answer, 50)
+}
+
+func TestDnsServer_Authority(t *testing.T) {
+	d := newDnsServer(newTestRegistry(testEntry("web", "10.0.0.1", true), testEntry("down", "10.0.0.2", false)), nil)
+
+	m := query(d, "web.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.True(t, m.Authoritative)
+	assert.Len(t, m.Answer, 1)
+	assert.Len(t, m.Ns, 0)
+
+	m = query(d, "watchdns.", dns.TypeSOA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, dns.TypeSOA, m.Answer[0].Header().Rrtype)
+	}
+
+	//NODATA: the name exists, but there is nothing of that type (or nothing healthy)
+	for _, name := range []string{"web.service.watchdns.", "down.service.watchdns.", "service.watchdns.", "watchdns."} {
+		m = query(d, name, dns.TypeMX)
+		assert.Equal(t, dns.RcodeSuccess, m.Rcode, name)
+		assert.True(t, m.Authoritative, name)
+		assert.Len(t, m.Answer, 0, name)
+		if assert.Len(t, m.Ns, 1, name) {
+			assert.Equal(t, dns.TypeSOA, m.Ns[0].Header().Rrtype, name)
+		}
+	}
+	m = query(d, "down.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+
+	m = query(d, "missing.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.True(t, m.Authoritative)
+	assert.Len(t, m.Ns, 1)
+
+	m = query(d, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, m.Rcode)
+	assert.False(t, m.Authoritative)
+}
+
+func TestDnsServer_Case(t *testing.T) {
+	e := testEntry("Web", "10.0.0.1", true)
+	e.SrvOptions = []*SrvOption{{Service: "HTTP", Protocol: "tcp", Port: 80}}
+	e.MaxAnswers = 1
+	r := newTestRegistry(e, testEntry("web", "10.0.0.2", true))
+	d := newDnsServer(r, nil)
+
+	//resolvers randomize the case of the names they ask for
+	m := query(d, "wEb.SERVICE.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "wEb.SERVICE.watchdns.", m.Answer[0].Header().Name)
+	}
+	assert.Equal(t, 1, r.LookupMaxAnswers("WEB.service.watchdns."))
+	m = query(d, "_http._TCP.WatchDNS.", dns.TypeSRV)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "_http._TCP.WatchDNS.", m.Answer[0].Header().Name)
+	}
+	m = query(d, "m-X.machine.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+}
+
+func TestDnsServer_AAAA(t *testing.T) {
+	v6 := testEntry("web", "2001:db8::1", true)
+	v6.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80}}
+	v4 := testEntry("web", "10.0.0.1", true)
+	d := newDnsServer(newTestRegistry(v6, v4), nil)
+
+	m := query(d, "web.service.watchdns.", dns.TypeA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String())
+	}
+	m = query(d, "web.service.watchdns.", dns.TypeAAAA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "2001:db8::1", m.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+	m = query(d, "_http._tcp.watchdns.", dns.TypeSRV)
+	assert.Len(t, m.Answer, 1)
+	if assert.Len(t, m.Extra, 1) {
+		assert.Equal(t, dns.TypeAAAA, m.Extra[0].Header().Rrtype)
+	}
+
+	//IPv6-only names have no A records, but still exist
+	d = newDnsServer(newTestRegistry(testEntry("web", "2001:db8::1", true)), nil)
+	m = query(d, "web.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 0)
+}
+
+func TestDnsServer_MaxAnswers(t *testing.T) {
+	entries := make([]*ServiceEntry, 0, 10)
+	for i := 0; i < 10; i++ {
+		e := testEntry("web", fmt.Sprintf("10.0.0.%d", i+1), true)
+		e.MaxAnswers = 3
+		e.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80, Weight: uint16(i)}}
+		entries = append(entries, e)
+	}
+	//the smallest limit of the units behind a name wins
+	entries[0].MaxAnswers = 0
+	entries[1].MaxAnswers = 4
+	r := newTestRegistry(entries...)
+	assert.Equal(t, 3, r.LookupMaxAnswers("web.service.watchdns."))
+	d := newDnsServer(r, nil)
+	answers := func() []string {
+		var ips []string
+		for _, rr := range query(d, "web.service.watchdns.", dns.TypeA).Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+	all := make([]string, 0, 10)
+	for _, a := range r.LookupA("web.service.watchdns.") {
+		all = append(all, a.Server.String())
+	}
+
+	assert.Equal(t, all[:3], answers())
+
+	r.Options.RecordSort = "roundrobin"
+	for i := 0; i < 12; i++ {
+		assert.Equal(t, []string{all[i%10], all[(i+1)%10], all[(i+2)%10]}, answers(), "query %d", i)
+	}
+
+	r.Options.RecordSort = "random"
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ips := answers()
+		assert.Len(t, ips, 3)
+		assert.NotEqual(t, ips[0], ips[1])
+		for _, ip := range ips {
+			seen[ip] = true
+		}
+	}
+	assert.Len(t, seen, 10)
+
+	//the unit with a weight of 0 only makes the cut by a small chance
+	r.Options.RecordSort = "weighted"
+	unweighted := 0
+	for i := 0; i < 100; i++ {
+		ips := answers()
+		assert.Len(t, ips, 3)
+		for _, ip := range ips {
+			if ip == "10.0.0.1" {
+				unweighted++
+			}
+		}
+	}
+	assert.True(t, unweighted < 25, "the unweighted unit was picked %d times", unweighted)
+
+	//SRV answers aren't limited
+	m := query(d, "_http._tcp.watchdns.", dns.TypeSRV)
+	assert.Len(t, m.Answer, 10)
+}
+
+func TestDnsServer_Ptr(t *testing.T) {
+	web := testEntry("web", "10.0.0.5", true)
+	web.Tags = []string{"i-1"}
+	down := testEntry("db", "10.0.0.5", false)
+	r := newTestRegistry(web, down)
+	r.setMachine("abcdef0123456789", "10.0.0.5")
+	r.setMachine("0123456789abcdef", "2001:db8::5")
+	r.publish()
+	d := newDnsServer(r, nil)
+	ptrs := func(name string) []string {
+		m := query(d, name, dns.TypePTR)
+		assert.Equal(t, dns.RcodeSuccess, m.Rcode, name)
+		assert.True(t, m.Authoritative, name)
+		var targets []string
+		for _, rr := range m.Answer {
+			targets = append(targets, rr.(*dns.PTR).Ptr)
+		}
+		return targets
+	}
+
+	assert.Equal(t, []string{"m-abcdef0123456789.machine.watchdns."}, ptrs("5.0.0.10.in-addr.arpa."))
+	rev, _ := dns.ReverseAddr("2001:db8::5")
+	assert.Equal(t, []string{"m-0123456789abcdef.machine.watchdns."}, ptrs(rev))
+
+	r.Options.ReverseServices = true
+	r.publish()
+	assert.Equal(t, []string{"m-abcdef0123456789.machine.watchdns.", "i-1.web.service.watchdns."}, ptrs("5.0.0.10.IN-ADDR.ARPA."))
+
+	//addresses we don't know about are still out of zone
+	m := query(d, "6.0.0.10.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeRefused, m.Rcode)
+	m = query(d, "5.0.0.10.in-addr.arpa.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, m.Rcode)
+}
+
+func TestDnsServer_Txt(t *testing.T) {
+	web := testEntry("web", "10.0.0.1", true)
+	web.UnitName = "web@1.service"
+	web.MachineId = "abcdef0123456789"
+	web.Tags = []string{"i-1"}
+	web.Txt = []string{"version=1.2", "path=/api"}
+	down := testEntry("web", "10.0.0.2", false)
+	down.UnitName = "web@2.service"
+	down.MachineId = "0123456789abcdef"
+	down.Tags = []string{"i-2"}
+	d := newDnsServer(newTestRegistry(web, down), nil)
+	txts := func(name string) [][]string {
+		var txt [][]string
+		for _, rr := range query(d, name, dns.TypeTXT).Answer {
+			txt = append(txt, rr.(*dns.TXT).Txt)
+		}
+		return txt
+	}
+
+	assert.Equal(t, [][]string{
+		{"version=1.2", "path=/api"},
+		{"unit=web@1.service", "machine=abcdef0123456789", "health=online"},
+		{"unit=web@2.service", "machine=0123456789abcdef", "health=offline"},
+	}, txts("web.service.watchdns."))
+	assert.Equal(t, [][]string{{"unit=web@2.service", "machine=0123456789abcdef", "health=offline"}}, txts("i-2.web.service.watchdns."))
+	assert.Equal(t, txts("i-2.web.service.watchdns."), txts("I-2.Web.Service.WATCHDNS."))
+}
+
+func TestDnsServer_Alias(t *testing.T) {
+	web := testEntry("api-v2", "10.0.0.1", true)
+	web.Aliases = []string{"api.watchdns."}
+	r := newTestRegistry(web)
+	d := newDnsServer(r, nil)
+	assert.True(t, r.LookupName("api.watchdns."))
+
+	m := query(d, "API.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	if assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, "api-v2.service.watchdns.", m.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "api-v2.service.watchdns.", m.Answer[1].Header().Name)
+		assert.Equal(t, "10.0.0.1", m.Answer[1].(*dns.A).A.String())
+	}
+	m = query(d, "api.watchdns.", dns.TypeCNAME)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, uint32(5), m.Answer[0].Header().Ttl)
+	}
+
+	//the alias stays while the unit is down, with nothing behind it
+	web.Online = false
+	r.publish()
+	m = query(d, "api.watchdns.", dns.TypeA)
+	assert.Len(t, m.Answer, 1)
+
+	//and goes away with the unit
+	r.unindexEntry(web)
+	r.publish()
+	m = query(d, "api.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+}
+
+func TestDnsServer_AliasConflict(t *testing.T) {
+	newer := testEntry("www-v2", "10.0.0.2", true)
+	newer.UnitName = "www-v2.service"
+	newer.Aliases = []string{"www.watchdns."}
+	older := testEntry("www-v1", "10.0.0.1", true)
+	older.UnitName = "www-v1.service"
+	older.CheckInterval = 30 * time.Second
+	older.Aliases = []string{"www.watchdns."}
+
+	//the lowest unit name wins no matter which unit claimed the alias first
+	for _, entries := range [][]*ServiceEntry{{newer, older}, {older, newer}} {
+		d := newDnsServer(newTestRegistry(entries...), nil)
+		m := query(d, "www.watchdns.", dns.TypeCNAME)
+		if assert.Len(t, m.Answer, 1) {
+			assert.Equal(t, "www-v1.service.watchdns.", m.Answer[0].(*dns.CNAME).Target)
+			assert.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		}
+		for _, e := range entries {
+			e.indexed = false
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"github.com/coreos/fleet/etcd"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EtcdHealthStore keeps the live replicas and their health reports in etcd,
+// relying on TTLs to forget replicas that went away:
+//
+//	<prefix>/members/<replica>
+//	<prefix>/health/<unit>@<replica>
+//
+// Reports are flat keys, a directory per unit would outlive its reports.
+type EtcdHealthStore struct {
+	etcd   etcd.Client
+	prefix string
+}
+
+func NewEtcdHealthStore(etcdPeers []string, prefix string, timeout time.Duration) (*EtcdHealthStore, error) {
+	cli, err := etcd.NewClient(etcdPeers, http.DefaultTransport.(*http.Transport), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdHealthStore{cli, prefix}, nil
+}
+
+func (s *EtcdHealthStore) Join(replicaId string, ttl time.Duration) error {
+	_, err := s.etcd.Do(&etcd.Set{Key: path.Join(s.prefix, "members", replicaId), Value: replicaId, TTL: ttl})
+	return err
+}
+
+func (s *EtcdHealthStore) Members() ([]string, error) {
+	res, err := s.get(path.Join(s.prefix, "members"))
+	if err != nil || res == nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(res.Node.Nodes))
+	for _, n := range res.Node.Nodes {
+		members = append(members, n.Value)
+	}
+	return members, nil
+}
+
+func (s *EtcdHealthStore) Report(unitId, replicaId string, online bool, ttl time.Duration) error {
+	_, err := s.etcd.Do(&etcd.Set{Key: path.Join(s.prefix, "health", reportKey(unitId, replicaId)), Value: strconv.FormatBool(online), TTL: ttl})
+	return err
+}
+
+func (s *EtcdHealthStore) Reports() (map[string]map[string]bool, error) {
+	res, err := s.get(path.Join(s.prefix, "health"))
+	if err != nil || res == nil {
+		return nil, err
+	}
+	reports := make(map[string]map[string]bool)
+	for _, n := range res.Node.Nodes {
+		unitId, replicaId, err := parseReportKey(path.Base(n.Key))
+		if err != nil {
+			continue
+		}
+		if reports[unitId] == nil {
+			reports[unitId] = make(map[string]bool)
+		}
+		reports[unitId][replicaId] = n.Value == "true"
+	}
+	return reports, nil
+}
+
+// reportKey escapes both ids, unit ids contain characters etcd would treat
+// specially in keys and neither may contain the separator
+func reportKey(unitId, replicaId string) string {
+	return url.QueryEscape(unitId) + "@" + url.QueryEscape(replicaId)
+}
+
+func parseReportKey(key string) (string, string, error) {
+	i := strings.IndexByte(key, '@')
+	if i == -1 {
+		return "", "", fmt.Errorf("invalid report key '%s'", key)
+	}
+	unitId, err := url.QueryUnescape(key[:i])
+	if err != nil {
+		return "", "", err
+	}
+	replicaId, err := url.QueryUnescape(key[i+1:])
+	return unitId, replicaId, err
+}
+
+// get reads a directory recursively, a missing one is returned as nil
+func (s *EtcdHealthStore) get(key string) (*etcd.Result, error) {
+	res, err := s.etcd.Do(&etcd.Get{Key: key, Recursive: true})
+	if eerr, ok := err.(etcd.Error); ok && eerr.ErrorCode == etcd.ErrorKeyNotFound {
+		return nil, nil
+	}
+	if err != nil || res.Node == nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/coreos/fleet/etcd"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReportKey(t *testing.T) {
+	key := reportKey("web@1.service:abcdef0123456789", "replica@1")
+	assert.NotContains(t, key, "/")
+	unitId, replicaId, err := parseReportKey(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "web@1.service:abcdef0123456789", unitId)
+	assert.Equal(t, "replica@1", replicaId)
+
+	_, _, err = parseReportKey("web.service")
+	assert.Error(t, err)
+}
+
+func TestEtcdHealthStore_Reports(t *testing.T) {
+	s := &EtcdHealthStore{&fakeEtcd{&etcd.Result{Node: &etcd.Node{Key: "/watchdns/health", Nodes: []etcd.Node{
+		{Key: "/watchdns/health/" + reportKey("web@1.service:abc", "a"), Value: "true"},
+		{Key: "/watchdns/health/" + reportKey("web@1.service:abc", "b"), Value: "false"},
+		{Key: "/watchdns/health/" + reportKey("web@2.service:abc", "a"), Value: "false"},
+		{Key: "/watchdns/health/old-directory"},
+	}}}}, "/watchdns"}
+	reports, err := s.Reports()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]bool{
+		"web@1.service:abc": {"a": true, "b": false},
+		"web@2.service:abc": {"a": false},
+	}, reports)
+}
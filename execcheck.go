@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxExecOutput limits how much of a check command's output is kept for logging
+const maxExecOutput = 4096
+
+// execWaitDelay is how long to wait for the output to be closed once a check
+// command exited, something it started in a session of its own can hold it
+// open and escape being killed with the process group
+const execWaitDelay = 500 * time.Millisecond
+
+// ExecCheck is a parsed CheckExec value: a command and its arguments, which
+// can be double-quoted. The unit is healthy when the command exits with 0.
+type ExecCheck struct {
+	Args []string
+}
+
+func parseExecCheck(val string) (*ExecCheck, error) {
+	args, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no command given")
+	}
+	return &ExecCheck{args}, nil
+}
+
+func (c *ExecCheck) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Check runs the command, killing it along with anything it started once the
+// timeout is reached
+func (c *ExecCheck) Check(timeout time.Duration) (string, error) {
+	out := &cappedBuffer{max: maxExecOutput}
+	cmd := exec.Command(c.Args[0], c.Args[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	//run in a process group of its own so children can be killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = execWaitDelay
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	doneCh := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		//the exit status is what counts, not what was left running
+		if errors.Is(err, exec.ErrWaitDelay) {
+			err = nil
+		}
+		doneCh <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-doneCh:
+		return out.String(), err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-doneCh
+		return out.String(), fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest.
+// The buffer isn't embedded so io.Copy can't bypass Write through ReadFrom
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecCheck_Check(t *testing.T) {
+	c, _ := parseExecCheck(`sh -c "echo fine; exit 0"`)
+	out, err := c.Check(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "fine\n", out)
+
+	c, _ = parseExecCheck(`sh -c "echo broken >&2; exit 3"`)
+	out, err = c.Check(time.Second)
+	assert.Error(t, err)
+	assert.Equal(t, "broken\n", out)
+
+	c, _ = parseExecCheck("/nonexistent/check")
+	_, err = c.Check(time.Second)
+	assert.Error(t, err)
+}
+
+func TestExecCheck_Timeout(t *testing.T) {
+	//the background sleep keeps the output open, so this only returns
+	//quickly if the whole process group is killed
+	c, _ := parseExecCheck(`sh -c "sleep 10 & sleep 10"`)
+	start := time.Now()
+	_, err := c.Check(100 * time.Millisecond)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "check should be killed at the timeout")
+}
+
+func TestExecCheck_Setsid(t *testing.T) {
+	//the sleep is out of reach of the process group, but it can't hold the check up
+	c, _ := parseExecCheck(`sh -c "setsid sleep 10 & exit 0"`)
+	start := time.Now()
+	_, err := c.Check(time.Second)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "check should return once the command exits")
+
+	c, _ = parseExecCheck(`sh -c "setsid sleep 10 & sleep 10"`)
+	start = time.Now()
+	_, err = c.Check(100 * time.Millisecond)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "check should be killed at the timeout")
+}
+
+func TestExecCheck_OutputCapped(t *testing.T) {
+	c, _ := parseExecCheck(`sh -c "yes | head -c 100000"`)
+	out, err := c.Check(time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, out, maxExecOutput)
+	assert.True(t, strings.HasPrefix(out, "y\ny\n"))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileBackend reads unit files from a directory and the machines they
+// run on from a YAML, TOML or JSON file, for hosts without fleet:
+//
+//	[[Machines]]
+//	ID = "host1"
+//	PublicIP = "10.0.0.5"
+//	Units = ["example@1.service", "example@2.service"]
+//
+// Instances fall back to their template (example@.service) when there
+// is no unit file for the instance itself. Every listed unit is
+// considered running.
+type FileBackend struct {
+	UnitDir      string
+	MachinesFile string
+	// PollInterval is how often to reload when the files can't be watched
+	PollInterval time.Duration
+}
+
+type fileMachine struct {
+	ID       string
+	PublicIP string
+	Units    []string
+}
+
+func NewFileBackend(unitDir, machinesFile string, pollInterval time.Duration) *FileBackend {
+	return &FileBackend{unitDir, machinesFile, pollInterval}
+}
+
+func (f *FileBackend) readMachines() ([]fileMachine, error) {
+	v := viper.New()
+	v.SetConfigFile(f.MachinesFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var machines []fileMachine
+	if err := v.UnmarshalKey("Machines", &machines); err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
+
+// unitFile returns the contents of a unit file, or its template
+func (f *FileBackend) unitFile(unitName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.UnitDir, unitName))
+	if os.IsNotExist(err) {
+		prefix, instance, unitType := parseUnitName(unitName)
+		if instance != "" {
+			return ioutil.ReadFile(filepath.Join(f.UnitDir, prefix+"@"+unitType))
+		}
+	}
+	return data, err
+}
+
+func (f *FileBackend) Machines() ([]*Machine, error) {
+	machines, err := f.readMachines()
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Machine, 0, len(machines))
+	for _, m := range machines {
+		ms = append(ms, &Machine{m.ID, m.PublicIP})
+	}
+	return ms, nil
+}
+
+// UnitStates reports every unit listed for a machine as active, the hash
+// of the unit file contents is used to only re-parse files that changed
+func (f *FileBackend) UnitStates() ([]*UnitState, error) {
+	machines, err := f.readMachines()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*UnitState, 0, len(machines)*4)
+	for _, m := range machines {
+		for _, name := range m.Units {
+			data, err := f.unitFile(name)
+			if err != nil {
+				log.Warnf("Could not read unit %s for machine %s: %s\n", name, m.ID, err.Error())
+				continue
+			}
+			sum := sha1.Sum(data)
+			states = append(states, &UnitState{name, m.ID, hex.EncodeToString(sum[:]), "active"})
+		}
+	}
+	return states, nil
+}
+
+func (f *FileBackend) UnitOptions(unitName string) ([]*unit.UnitOption, error) {
+	data, err := f.unitFile(unitName)
+	if err != nil {
+		return nil, err
+	}
+	return unit.Deserialize(bytes.NewReader(data))
+}
+
+// Watch asks for a full reload whenever anything in the unit directory
+// or the machines file changes, bursts of changes are coalesced
+func (f *FileBackend) Watch(eventCh chan<- *BackendEvent, stopCh <-chan struct{}) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("Could not watch unit files, polling every %s instead: %s\n", f.PollInterval, err.Error())
+		f.poll(eventCh, stopCh)
+		return
+	}
+	defer w.Close()
+	for _, dir := range []string{f.UnitDir, filepath.Dir(f.MachinesFile)} {
+		//a directory that doesn't exist yet can't be watched, only polled
+		if err := w.Add(dir); err != nil {
+			log.Warnf("Could not watch %s, polling every %s instead: %s\n", dir, f.PollInterval, err.Error())
+			f.poll(eventCh, stopCh)
+			return
+		}
+	}
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-stopCh:
+			return
+		case ev := <-w.Events:
+			log.Debugln("File event:", ev)
+			if pending == nil {
+				pending = time.After(100 * time.Millisecond)
+			}
+		case err := <-w.Errors:
+			log.Warn("Error watching unit files:", err)
+		case <-pending:
+			pending = nil
+			select {
+			case eventCh <- nil:
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
+
+// poll asks for a full reload every PollInterval, as the registry only
+// reloads every ReloadInterval on its own while the backend is watched
+func (f *FileBackend) poll(eventCh chan<- *BackendEvent, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(f.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			select {
+			case eventCh <- nil:
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testWebUnit = `[Service]
+ExecStart=/usr/bin/web --port %i
+
+[X-Watchdns]
+Srv=http:tcp:%i
+CheckTcp=%H:%i
+CheckInterval=1s
+`
+
+func writeFile(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFileBackend(t *testing.T, ports ...int) *FileBackend {
+	dir := t.TempDir()
+	units := ""
+	for _, p := range ports {
+		units += `, "web@` + strconv.Itoa(p) + `.service"`
+	}
+	writeFile(t, filepath.Join(dir, "machines.toml"), `[[Machines]]
+ID = "abcdef0123456789"
+PublicIP = "127.0.0.1"
+Units = [`+units[2:]+`]
+`)
+	writeFile(t, filepath.Join(dir, "web@.service"), testWebUnit)
+	return NewFileBackend(dir, filepath.Join(dir, "machines.toml"), time.Second)
+}
+
+func TestFileBackend(t *testing.T) {
+	f := newTestFileBackend(t, 8080, 8081)
+	writeFile(t, filepath.Join(f.UnitDir, "web@8081.service"), "[X-Watchdns]\nName=other\n")
+
+	ms, err := f.Machines()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Machine{{"abcdef0123456789", "127.0.0.1"}}, ms)
+
+	states, err := f.UnitStates()
+	assert.NoError(t, err)
+	if assert.Len(t, states, 2) {
+		assert.Equal(t, "web@8080.service", states[0].UnitName)
+		assert.Equal(t, "active", states[0].ActiveState)
+		assert.NotEqual(t, states[0].UnitHash, states[1].UnitHash)
+	}
+
+	//instances without their own file use the template
+	opts, err := f.UnitOptions("web@8080.service")
+	assert.NoError(t, err)
+	assert.Len(t, opts, 4)
+	opts, err = f.UnitOptions("web@8081.service")
+	assert.NoError(t, err)
+	assert.Len(t, opts, 1)
+	_, err = f.UnitOptions("missing.service")
+	assert.Error(t, err)
+}
+
+func TestFileBackend_EndToEnd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := l.Addr().(*net.TCPAddr).Port
+	l2, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l2.Addr().(*net.TCPAddr).Port
+	l2.Close()
+	defer l.Close()
+
+	r := newTestRegistry()
+	r.backend = newTestFileBackend(t, up, down)
+	r.Options.CheckTimeout = time.Second
+	r.hRateCh = make(chan bool, 2)
+	r.reloadBackend()
+	resultCh := make(chan HealthCheckResult, 2)
+	r.doHealthChecks(resultCh)
+	r.processHealthCheckResult(<-resultCh)
+	r.processHealthCheckResult(<-resultCh)
+	r.publish()
+
+	d := newDnsServer(r, nil)
+	m := query(d, "web.service.watchdns.", dns.TypeA)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "127.0.0.1", m.Answer[0].(*dns.A).A.String())
+	}
+	m = query(d, "_http._tcp.watchdns.", dns.TypeSRV)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, uint16(up), m.Answer[0].(*dns.SRV).Port)
+	}
+	m = query(d, "i-"+strconv.Itoa(down)+".web.service.watchdns.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 0)
+}
+
+func TestFileBackend_Watch(t *testing.T) {
+	f := newTestFileBackend(t, 8080)
+	eventCh := make(chan *BackendEvent, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go f.Watch(eventCh, stopCh)
+	//give the watcher a moment to start
+	time.Sleep(50 * time.Millisecond)
+
+	writeFile(t, filepath.Join(f.UnitDir, "web@8080.service"), "[X-Watchdns]\nName=other\n")
+	select {
+	case ev := <-eventCh:
+		assert.Nil(t, ev)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reload after a unit file changed")
+	}
+}
+
+func TestFileBackend_Poll(t *testing.T) {
+	f := NewFileBackend(t.TempDir(), "machines.toml", 10*time.Millisecond)
+	eventCh := make(chan *BackendEvent, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go f.poll(eventCh, stopCh)
+	select {
+	case ev := <-eventCh:
+		assert.Nil(t, ev)
+	case <-time.After(time.Second):
+		t.Fatal("no reload while polling")
+	}
+}
+
+func TestFileBackend_WatchMissingDir(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFileBackend(filepath.Join(dir, "units"), filepath.Join(dir, "machines.toml"), 10*time.Millisecond)
+	eventCh := make(chan *BackendEvent, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go f.Watch(eventCh, stopCh)
+
+	//the unit directory can't be watched until it's created, so it's polled
+	select {
+	case ev := <-eventCh:
+		assert.Nil(t, ev)
+	case <-time.After(time.Second):
+		t.Fatal("no reload for a missing unit directory")
+	}
+}
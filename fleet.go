@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+	"github.com/coreos/fleet/etcd"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/registry"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FleetBackend reads machines and units from the fleet registry in etcd
+type FleetBackend struct {
+	etcd     etcd.Client
+	registry *registry.EtcdRegistry
+	prefix   string
+	retry    time.Duration
+}
+
+// fleetUnitState mirrors how fleet stores unit states in etcd
+type fleetUnitState struct {
+	LoadState    string                `json:"loadState"`
+	ActiveState  string                `json:"activeState"`
+	SubState     string                `json:"subState"`
+	MachineState *machine.MachineState `json:"machineState"`
+	UnitHash     string                `json:"unitHash"`
+}
+
+// NewFleetBackend connects to etcd, retry is how long to wait before
+// restarting a failed watch
+func NewFleetBackend(etcdPeers []string, prefix string, timeout, retry time.Duration) (*FleetBackend, error) {
+	log.Debugln("Using etcd peers:", etcdPeers)
+	cli, err := etcd.NewClient(etcdPeers, http.DefaultTransport.(*http.Transport), timeout)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugln("Using fleet prefix:", prefix)
+	return &FleetBackend{cli, registry.NewEtcdRegistry(cli, prefix), prefix, retry}, nil
+}
+
+func (f *FleetBackend) Machines() ([]*Machine, error) {
+	machines, err := f.registry.Machines()
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Machine, 0, len(machines))
+	for _, m := range machines {
+		ms = append(ms, &Machine{m.ID, m.PublicIP})
+	}
+	return ms, nil
+}
+
+func (f *FleetBackend) UnitStates() ([]*UnitState, error) {
+	states, err := f.registry.UnitStates()
+	if err != nil {
+		return nil, err
+	}
+	us := make([]*UnitState, 0, len(states))
+	for _, s := range states {
+		us = append(us, &UnitState{s.UnitName, s.MachineID, s.UnitHash, s.ActiveState})
+	}
+	return us, nil
+}
+
+func (f *FleetBackend) UnitOptions(unitName string) ([]*unit.UnitOption, error) {
+	u, err := f.registry.Unit(unitName)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return u.Unit.Options, nil
+}
+
+// Watch follows changes under the fleet prefix. A nil event is sent
+// whenever the watch had to be restarted and events may have been lost.
+func (f *FleetBackend) Watch(eventCh chan<- *BackendEvent, stopCh <-chan struct{}) {
+	var index uint64
+	for {
+		res, err := f.etcd.Wait(&etcd.Watch{Key: f.prefix, WaitIndex: index, Recursive: true}, stopCh)
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		if err != nil || res == nil || res.Node == nil {
+			log.Warn("Fleet watch failed, falling back to a full reload:", err)
+			index = 0
+			select {
+			case eventCh <- nil:
+			case <-stopCh:
+				return
+			}
+			select {
+			case <-time.After(f.retry):
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+		index = res.Node.ModifiedIndex + 1
+		if ev := f.event(res); ev != nil {
+			select {
+			case eventCh <- ev:
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
+
+// event translates a change in etcd into a BackendEvent, only machine
+// objects and unit states affect what we serve
+func (f *FleetBackend) event(res *etcd.Result) *BackendEvent {
+	key := strings.TrimPrefix(res.Node.Key, strings.TrimSuffix(f.prefix, "/")+"/")
+	parts := strings.Split(key, "/")
+	removed := res.Action == "delete" || res.Action == "expire" || res.Action == "compareAndDelete"
+	log.Debugln("Fleet event:", res.Action, key)
+	switch {
+	case parts[0] == "machines" && len(parts) >= 2:
+		if removed {
+			return &BackendEvent{Machine: &Machine{ID: parts[1]}, Removed: true}
+		}
+		if len(parts) != 3 || parts[2] != "object" {
+			return nil
+		}
+		var ms machine.MachineState
+		if err := json.Unmarshal([]byte(res.Node.Value), &ms); err != nil {
+			log.Warn("Could not decode machine from fleet:", err)
+			return nil
+		}
+		return &BackendEvent{Machine: &Machine{parts[1], ms.PublicIP}}
+	case parts[0] == "states" && len(parts) >= 2:
+		machineId := ""
+		if len(parts) >= 3 {
+			machineId = parts[2]
+		}
+		if removed {
+			return &BackendEvent{UnitState: &UnitState{UnitName: parts[1], MachineID: machineId}, Removed: true}
+		}
+		if machineId == "" {
+			return nil
+		}
+		var us fleetUnitState
+		if err := json.Unmarshal([]byte(res.Node.Value), &us); err != nil {
+			log.Warn("Could not decode unit state from fleet:", err)
+			return nil
+		}
+		return &BackendEvent{UnitState: &UnitState{parts[1], machineId, us.UnitHash, us.ActiveState}}
+	}
+	return nil
+}
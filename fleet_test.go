@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/coreos/fleet/etcd"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// fakeEtcd answers every wait with the same change
+type fakeEtcd struct {
+	res *etcd.Result
+}
+
+func (c *fakeEtcd) Do(etcd.Action) (*etcd.Result, error) {
+	return c.res, nil
+}
+
+func (c *fakeEtcd) Wait(etcd.Action, <-chan struct{}) (*etcd.Result, error) {
+	return c.res, nil
+}
+
+func fleetEvent(action, key, value string) *etcd.Result {
+	return &etcd.Result{Action: action, Node: &etcd.Node{Key: "/_coreos.com/fleet/" + key, Value: value}}
+}
+
+func TestFleetBackend_Event(t *testing.T) {
+	f := &FleetBackend{prefix: "/_coreos.com/fleet/"}
+
+	ev := f.event(fleetEvent("compareAndSwap", "machines/abcdef0123456789/object", `{"ID":"abcdef0123456789","PublicIP":"10.0.0.5"}`))
+	assert.Equal(t, &BackendEvent{Machine: &Machine{"abcdef0123456789", "10.0.0.5"}}, ev)
+	ev = f.event(fleetEvent("expire", "machines/abcdef0123456789", ""))
+	assert.Equal(t, &BackendEvent{Machine: &Machine{ID: "abcdef0123456789"}, Removed: true}, ev)
+
+	ev = f.event(fleetEvent("set", "states/web.service/abcdef0123456789", `{"activeState":"active","unitHash":"h1"}`))
+	assert.Equal(t, &BackendEvent{UnitState: &UnitState{"web.service", "abcdef0123456789", "h1", "active"}}, ev)
+	ev = f.event(fleetEvent("delete", "states/web.service", ""))
+	assert.Equal(t, &BackendEvent{UnitState: &UnitState{UnitName: "web.service"}, Removed: true}, ev)
+
+	assert.Nil(t, f.event(fleetEvent("set", "job/web.service/target-state", "launched")))
+	assert.Nil(t, f.event(fleetEvent("set", "states/web.service/abcdef0123456789", "not json")))
+}
+
+func TestFleetBackend_WatchStop(t *testing.T) {
+	f := &FleetBackend{etcd: &fakeEtcd{fleetEvent("set", "states/web.service/abcdef0123456789", `{"activeState":"active"}`)}, prefix: "/_coreos.com/fleet/"}
+	eventCh := make(chan *BackendEvent)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.Watch(eventCh, stopCh)
+		close(done)
+	}()
+	<-eventCh
+
+	//nobody reads the events anymore, stopping must not wait for that
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch didn't stop")
+	}
+}
+
+func TestProcessBackendEvent(t *testing.T) {
+	r := newTestRegistry()
+
+	r.processBackendEvent(&BackendEvent{Machine: &Machine{"abcdef0123456789", "10.0.0.5"}})
+	r.publish()
+	assert.True(t, r.LookupName("m-abcdef01.machine.watchdns."))
+	if ans := r.LookupA("m-abcdef0123456789.machine.watchdns."); assert.Len(t, ans, 1) {
+		assert.Equal(t, "10.0.0.5", ans[0].Server.String())
+	}
+
+	//the unit hash and address are unchanged, so the unit file isn't re-read
+	e := testEntry("web", "10.0.0.5", true)
+	e.UnitName = "web.service"
+	e.MachineId = "abcdef0123456789"
+	e.UnitHash = "h1"
+	r.units["web.service:abcdef0123456789"] = e
+	r.processBackendEvent(&BackendEvent{UnitState: &UnitState{"web.service", "abcdef0123456789", "h1", "active"}})
+	r.publish()
+	assert.True(t, e.Running)
+	assert.Len(t, r.LookupA("web.service.watchdns."), 1)
+
+	r.processBackendEvent(&BackendEvent{UnitState: &UnitState{"web.service", "abcdef0123456789", "h1", "failed"}})
+	r.publish()
+	assert.False(t, e.Running)
+	assert.Len(t, r.LookupA("web.service.watchdns."), 0)
+	assert.True(t, r.LookupName("web.service.watchdns."))
+
+	r.processBackendEvent(&BackendEvent{UnitState: &UnitState{UnitName: "web.service"}, Removed: true})
+	r.publish()
+	assert.False(t, r.LookupName("web.service.watchdns."))
+	assert.False(t, r.LookupName("service.watchdns."))
+
+	r.processBackendEvent(&BackendEvent{Machine: &Machine{ID: "abcdef0123456789"}, Removed: true})
+	r.publish()
+	assert.False(t, r.LookupName("m-abcdef01.machine.watchdns."))
+	assert.Len(t, r.LookupA("m-abcdef0123456789.machine.watchdns."), 0)
+	assert.True(t, r.LookupName("watchdns."))
+}
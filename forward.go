@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// Forwarder proxies queries for names outside of the watch domain
+// to a list of upstream resolvers, tried in order
+type Forwarder struct {
+	Upstreams []string
+	Timeout   time.Duration
+}
+
+// NewForwarder parses a comma-delimited list of upstream resolvers,
+// addresses without a port default to 53
+func NewForwarder(upstreams string, timeout time.Duration) *Forwarder {
+	f := new(Forwarder)
+	f.Timeout = timeout
+	for _, u := range strings.Split(upstreams, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(strings.Trim(u, "[]"), "53")
+		}
+		f.Upstreams = append(f.Upstreams, u)
+	}
+	return f
+}
+
+// Forward sends the query to each upstream until one gives a usable answer,
+// a SERVFAIL or REFUSED response moves on to the next upstream but is
+// returned if nothing better comes along
+func (f *Forwarder) Forward(r *dns.Msg) (*dns.Msg, error) {
+	var last *dns.Msg
+	for _, upstream := range f.Upstreams {
+		resp, err := f.exchange(r, upstream)
+		if err != nil {
+			log.Warnf("Upstream %s failed: %s\n", upstream, err.Error())
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			log.Debugf("Upstream %s answered %s\n", upstream, dns.RcodeToString[resp.Rcode])
+			last = resp
+			continue
+		}
+		return resp, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, errors.New("no upstream resolvers available")
+}
+
+// exchange queries a single upstream over UDP, retrying over TCP
+// if the response was truncated
+func (f *Forwarder) exchange(r *dns.Msg, upstream string) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: f.Timeout}
+	resp, _, err := c.Exchange(r, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(r, upstream)
+	}
+	return resp, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// startStubServer runs an in-process resolver on a random local port
+// for both UDP and TCP, returning its address
+func startStubServer(t *testing.T, handler dns.HandlerFunc) string {
+	var pc net.PacketConn
+	var l net.Listener
+	//the UDP port can be taken for TCP, so try again with another one
+	for i := 0; l == nil; i++ {
+		var err error
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func stubAnswer(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		m.Answer = append(m.Answer, addressRR(r.Question[0].Name, net.ParseIP(ip), time.Minute))
+		w.WriteMsg(m)
+	}
+}
+
+func TestNewForwarder(t *testing.T) {
+	f := NewForwarder("8.8.8.8, 127.0.0.1:5353,,2001:db8::1,[2001:db8::2]:54", time.Second)
+	assert.Equal(t, []string{"8.8.8.8:53", "127.0.0.1:5353", "[2001:db8::1]:53", "[2001:db8::2]:54"}, f.Upstreams)
+}
+
+func TestForwarder_Failover(t *testing.T) {
+	refused := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	})
+	good := startStubServer(t, stubAnswer("192.0.2.1"))
+	//nothing listens on the discard port, so this upstream times out or errors
+	f := &Forwarder{[]string{"127.0.0.1:9", refused, good}, 200 * time.Millisecond}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := f.Forward(req)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	f = &Forwarder{[]string{refused}, 200 * time.Millisecond}
+	resp, err = f.Forward(req)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	f = &Forwarder{[]string{"127.0.0.1:9"}, 200 * time.Millisecond}
+	_, err = f.Forward(req)
+	assert.Error(t, err)
+}
+
+func TestForwarder_TcpRetry(t *testing.T) {
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+		} else {
+			m.Answer = append(m.Answer, addressRR(r.Question[0].Name, net.ParseIP("192.0.2.2"), time.Minute))
+		}
+		w.WriteMsg(m)
+	})
+	f := &Forwarder{[]string{addr}, time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := f.Forward(req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestDnsServer_Forward(t *testing.T) {
+	addr := startStubServer(t, stubAnswer("192.0.2.3"))
+	d := newDnsServer(newTestRegistry(testEntry("web", "10.0.0.1", true)), &Forwarder{[]string{addr}, time.Second})
+
+	m := query(d, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.False(t, m.Authoritative)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.0.2.3", m.Answer[0].(*dns.A).A.String())
+	}
+
+	//names in the watch domain are still answered locally
+	m = query(d, "web.service.watchdns.", dns.TypeA)
+	assert.True(t, m.Authoritative)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String())
+	}
+
+	d = newDnsServer(newTestRegistry(), &Forwarder{[]string{"127.0.0.1:9"}, 200 * time.Millisecond})
+	m = query(d, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+}
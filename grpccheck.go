@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GrpcCheck is a parsed CheckGrpc value, in the format:
+//
+//	<host>:<port>[/service] [option=value]...
+//
+// It calls grpc.health.v1.Health/Check for the service (the server as a whole
+// when empty), only SERVING is healthy. Options are tls (plaintext by default),
+// tls-skip-verify, tls-ca, tls-cert and tls-key, the last four imply tls.
+type GrpcCheck struct {
+	Address string
+	Service string
+	TLS     *tls.Config
+}
+
+func parseGrpcCheck(val string) (*GrpcCheck, error) {
+	fields, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing address")
+	}
+	c := new(GrpcCheck)
+	c.Address = fields[0]
+	if i := strings.IndexByte(c.Address, '/'); i != -1 {
+		c.Address, c.Service = c.Address[:i], c.Address[i+1:]
+	}
+	var caFile, certFile, keyFile string
+	var useTls, skipVerify bool
+	for _, f := range fields[1:] {
+		name, value, err := splitOption(f)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "tls":
+			useTls, err = strconv.ParseBool(value)
+		case "tls-skip-verify":
+			skipVerify, err = strconv.ParseBool(value)
+		case "tls-ca":
+			caFile = value
+		case "tls-cert":
+			certFile = value
+		case "tls-key":
+			keyFile = value
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if useTls || skipVerify || caFile != "" || certFile != "" || keyFile != "" {
+		c.TLS, err = loadTlsConfig(skipVerify, caFile, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *GrpcCheck) String() string {
+	if c.Service == "" {
+		return c.Address
+	}
+	return c.Address + "/" + c.Service
+}
+
+// Check calls the health service, a fresh connection is used for every check
+func (c *GrpcCheck) Check(timeout time.Duration) error {
+	creds := insecure.NewCredentials()
+	if c.TLS != nil {
+		creds = credentials.NewTLS(c.TLS)
+	}
+	conn, err := grpc.NewClient("passthrough:///"+c.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: c.Service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service is %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"testing"
+	"time"
+)
+
+func startHealthServer(t *testing.T, opts ...grpc.ServerOption) (string, *health.Server) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	srv := grpc.NewServer(opts...)
+	grpc_health_v1.RegisterHealthServer(srv, hs)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String(), hs
+}
+
+func TestParseGrpcCheck(t *testing.T) {
+	c, err := parseGrpcCheck("10.0.0.1:5000")
+	assert.NoError(t, err)
+	assert.Equal(t, &GrpcCheck{"10.0.0.1:5000", "", nil}, c)
+	assert.Equal(t, "10.0.0.1:5000", c.String())
+
+	c, err = parseGrpcCheck("10.0.0.1:5000/example.Example tls=true")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.Example", c.Service)
+	assert.NotNil(t, c.TLS)
+	assert.Equal(t, "10.0.0.1:5000/example.Example", c.String())
+
+	for _, v := range []string{"", "10.0.0.1:5000 tls=maybe", "10.0.0.1:5000 nope=1"} {
+		_, err = parseGrpcCheck(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestGrpcCheck_Check(t *testing.T) {
+	addr, hs := startHealthServer(t)
+	hs.SetServingStatus("example.Example", grpc_health_v1.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("example.Broken", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	c, _ := parseGrpcCheck(addr)
+	assert.NoError(t, c.Check(time.Second), "the server itself")
+	c, _ = parseGrpcCheck(addr + "/example.Example")
+	assert.NoError(t, c.Check(time.Second))
+	c, _ = parseGrpcCheck(addr + "/example.Broken")
+	assert.Error(t, c.Check(time.Second))
+	c, _ = parseGrpcCheck(addr + "/example.Unknown")
+	assert.Error(t, c.Check(time.Second))
+	c, _ = parseGrpcCheck(addr + " tls=true")
+	assert.Error(t, c.Check(time.Second), "server is plaintext")
+}
+
+func TestGrpcCheck_TLS(t *testing.T) {
+	cert := selfSignedCert(t, x509.ExtKeyUsageServerAuth, time.Now().Add(time.Hour))
+	addr, _ := startHealthServer(t, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+
+	c, _ := parseGrpcCheck(addr)
+	assert.Error(t, c.Check(time.Second), "server is TLS")
+	c, _ = parseGrpcCheck(addr + " tls=true")
+	assert.Error(t, c.Check(time.Second), "self-signed certificates don't verify")
+	c, _ = parseGrpcCheck(addr + " tls-skip-verify=true")
+	assert.NoError(t, c.Check(time.Second))
+}
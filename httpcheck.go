@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCheckBody limits how much of a response is read when matching the body
+const maxCheckBody = 1 << 20
+
+// HttpCheck is a parsed CheckHttp value, in the format:
+//
+//	<url> [option=value]...
+//
+// Options are method, header (Name:Value, may be repeated), host, status
+// (codes or ranges like 200,300-399, any 2xx when unset), body (substring),
+// body-regex, tls-skip-verify, tls-ca, tls-cert and tls-key. Values with
+// spaces can be double-quoted.
+type HttpCheck struct {
+	URL       *url.URL
+	Method    string
+	Header    http.Header
+	Host      string
+	Status    [][2]int
+	Body      string
+	BodyRegex *regexp.Regexp
+	TLS       *tls.Config
+}
+
+// splitQuoted splits on whitespace, keeping double-quoted runs together
+func splitQuoted(val string) ([]string, error) {
+	fields := make([]string, 0, 4)
+	var cur bytes.Buffer
+	inField, inQuote := false, false
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(val):
+			i++
+			cur.WriteByte(val[i])
+		case c == '"':
+			inQuote = !inQuote
+			inField = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteByte(c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
+
+func parseStatusRanges(val string) ([][2]int, error) {
+	ranges := make([][2]int, 0, 2)
+	for _, part := range strings.Split(val, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad status '%s'", part)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.Atoi(bounds[1])
+			if err != nil || hi < lo {
+				return nil, fmt.Errorf("bad status range '%s'", part)
+			}
+		}
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	return ranges, nil
+}
+
+func parseHttpCheck(val string) (*HttpCheck, error) {
+	fields, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing url")
+	}
+	c := new(HttpCheck)
+	c.URL, err = url.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	c.Method = "GET"
+	c.Header = make(http.Header)
+	var caFile, certFile, keyFile string
+	var skipVerify bool
+	for _, f := range fields[1:] {
+		name, value, err := splitOption(f)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "method":
+			c.Method = strings.ToUpper(value)
+		case "header":
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("header '%s' should be in format <name>:<value>", value)
+			}
+			c.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		case "host":
+			c.Host = value
+		case "status":
+			c.Status, err = parseStatusRanges(value)
+			if err != nil {
+				return nil, err
+			}
+		case "body":
+			c.Body = value
+		case "body-regex":
+			c.BodyRegex, err = regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+		case "tls-skip-verify":
+			skipVerify, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+		case "tls-ca":
+			caFile = value
+		case "tls-cert":
+			certFile = value
+		case "tls-key":
+			keyFile = value
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+	}
+	if skipVerify || caFile != "" || certFile != "" || keyFile != "" {
+		c.TLS, err = loadTlsConfig(skipVerify, caFile, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func loadTlsConfig(skipVerify bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (c *HttpCheck) String() string {
+	return c.Method + " " + c.URL.String()
+}
+
+// Check performs the request, returning why the check failed (if it did)
+func (c *HttpCheck) Check(timeout time.Duration) error {
+	//redirects are judged by their own status, not where they lead
+	cli := http.Client{Timeout: timeout, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if c.TLS != nil {
+		//keep-alives would leave a connection per check hanging around
+		cli.Transport = &http.Transport{TLSClientConfig: c.TLS, DisableKeepAlives: true}
+	}
+	req, err := http.NewRequest(c.Method, c.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return err
+	}
+	if !c.statusOk(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if c.Body != "" && !bytes.Contains(body, []byte(c.Body)) {
+		return fmt.Errorf("body does not contain '%s'", c.Body)
+	}
+	if c.BodyRegex != nil && !c.BodyRegex.Match(body) {
+		return fmt.Errorf("body does not match '%s'", c.BodyRegex)
+	}
+	return nil
+}
+
+func (c *HttpCheck) statusOk(code int) bool {
+	if len(c.Status) == 0 {
+		return code/100 == 2
+	}
+	for _, r := range c.Status {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
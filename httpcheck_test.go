@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	f, err := splitQuoted(`http://h/ body="all \"good\"" 	method=POST`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://h/", `body=all "good"`, "method=POST"}, f)
+	_, err = splitQuoted(`http://h/ body="oops`)
+	assert.Error(t, err)
+}
+
+func TestParseHttpCheck(t *testing.T) {
+	c, err := parseHttpCheck("http://10.0.0.1:4000/check")
+	assert.NoError(t, err)
+	assert.Equal(t, "GET http://10.0.0.1:4000/check", c.String())
+	assert.Nil(t, c.TLS)
+
+	c, err = parseHttpCheck(`http://10.0.0.1/ method=head header="X-Check: yes" header=Accept:text/plain host=example.com status=200,300-399 body=ok body-regex=^o tls-skip-verify=true`)
+	assert.NoError(t, err)
+	assert.Equal(t, "HEAD", c.Method)
+	assert.Equal(t, "yes", c.Header.Get("X-Check"))
+	assert.Equal(t, "text/plain", c.Header.Get("Accept"))
+	assert.Equal(t, "example.com", c.Host)
+	assert.Equal(t, [][2]int{{200, 200}, {300, 399}}, c.Status)
+	assert.Equal(t, "ok", c.Body)
+	assert.Equal(t, "^o", c.BodyRegex.String())
+	assert.True(t, c.TLS.InsecureSkipVerify)
+
+	for _, bad := range []string{"", "http://h/ status=abc", "http://h/ status=300-200", "http://h/ body-regex=(", "http://h/ nope=1", "http://h/ header=bad", "http://h/ method", "http://h/ tls-ca=/does/not/exist"} {
+		_, err = parseHttpCheck(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestHttpCheck_Check(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Check") != "" {
+			w.Header().Set("X-Check", req.Header.Get("X-Check"))
+		}
+		switch req.URL.Path {
+		case "/host":
+			w.Write([]byte(req.Host))
+		case "/method":
+			w.Write([]byte(req.Method + " " + req.Header.Get("X-Check")))
+		case "/redirect":
+			http.Redirect(w, req, "/", http.StatusFound)
+		default:
+			w.Write([]byte("all systems go"))
+		}
+	}))
+	defer srv.Close()
+
+	for val, ok := range map[string]bool{
+		srv.URL + "/":                                                         true,
+		srv.URL + "/ body=systems":                                            true,
+		srv.URL + "/ body=failure":                                            false,
+		srv.URL + `/ body-regex=^all\s+\w+`:                                   true,
+		srv.URL + "/ body-regex=^systems":                                     false,
+		srv.URL + "/redirect":                                                 false,
+		srv.URL + "/redirect status=300-399":                                  true,
+		srv.URL + "/redirect status=200,300-399":                              true,
+		srv.URL + "/ status=500":                                              false,
+		srv.URL + "/host host=example.com body=example.com":                   true,
+		srv.URL + `/method method=POST header="X-Check: yes" body="POST yes"`: true,
+	} {
+		c, err := parseHttpCheck(val)
+		if !assert.NoError(t, err, val) {
+			continue
+		}
+		err = c.Check(time.Second)
+		assert.Equal(t, ok, err == nil, val)
+	}
+}
+
+func TestHttpCheck_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	ca := writeCA(t, srv.Certificate())
+
+	c, _ := parseHttpCheck(srv.URL)
+	assert.Error(t, c.Check(time.Second), "self-signed certificates don't verify")
+	c, _ = parseHttpCheck(srv.URL + " tls-skip-verify=true")
+	assert.NoError(t, c.Check(time.Second))
+	c, err := parseHttpCheck(srv.URL + " tls-ca=" + ca)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Check(time.Second))
+
+	_, err = parseHttpCheck(srv.URL + " tls-ca=" + ca + " tls-cert=" + ca)
+	assert.Error(t, err, "a client certificate needs its key")
+}
+
+func TestHttpCheck_ClientCert(t *testing.T) {
+	cert := selfSignedCert(t, x509.ExtKeyUsageClientAuth, time.Now().Add(time.Hour))
+	certFile, keyFile := writeKeyPair(t, cert)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	c, _ := parseHttpCheck(srv.URL + " tls-skip-verify=true")
+	assert.Error(t, c.Check(time.Second))
+	c, err := parseHttpCheck(srv.URL + " tls-skip-verify=true tls-cert=" + certFile + " tls-key=" + keyFile)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Check(time.Second))
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/coreos/fleet/registry"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -32,27 +34,86 @@ func registryOptions() *RegistryOptions {
 	opts.Domain = viper.GetString("Domain")
 	opts.CheckInterval = mustParseDurationKey("CheckInterval")
 	opts.CheckTimeout = mustParseDurationKey("CheckTimeout")
+	if opts.CheckInterval > 0 && opts.CheckTimeout >= opts.CheckInterval {
+		log.Fatalln("CheckTimeout must be shorter than CheckInterval")
+	}
 	opts.CheckResolution = mustParseDurationKey("CheckResolution")
+	opts.HealthyThreshold = viper.GetInt("HealthyThreshold")
+	opts.UnhealthyThreshold = viper.GetInt("UnhealthyThreshold")
+	if opts.HealthyThreshold < 1 || opts.UnhealthyThreshold < 1 {
+		log.Fatalln("HealthyThreshold and UnhealthyThreshold must be at least 1")
+	}
+	opts.UnitGracePeriod = mustParseDurationKey("UnitGracePeriod")
 	opts.FleetInterval = mustParseDurationKey("FleetInterval")
+	opts.Watch = viper.GetBool("Watch")
+	opts.ReloadInterval = mustParseDurationKey("ReloadInterval")
+	opts.ReplicaId = viper.GetString("ReplicaId")
+	if opts.ReplicaId == "" {
+		opts.ReplicaId, _ = os.Hostname()
+	}
+	opts.CheckReplicas = viper.GetInt("CheckReplicas")
+	if opts.CheckReplicas < 1 {
+		log.Fatalln("CheckReplicas must be at least 1")
+	}
+	opts.SyncInterval = mustParseDurationKey("SyncInterval")
+	opts.MaxAnswers = viper.GetInt("MaxAnswers")
+	if opts.MaxAnswers < 0 {
+		log.Fatalln("MaxAnswers can't be negative")
+	}
+	opts.ReverseServices = viper.GetBool("ReverseServices")
 	opts.RecordSort = viper.GetString("RecordSort")
-	if opts.RecordSort != "default" && opts.RecordSort != "random" && opts.RecordSort != "roundrobin" {
+	if opts.RecordSort != "default" && opts.RecordSort != "random" && opts.RecordSort != "roundrobin" && opts.RecordSort != "weighted" {
 		log.Fatalln("Unknown RecordSort value: ", opts.RecordSort)
 	}
 	return opts
 }
 
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case "fleet":
+		peers := strings.Split(viper.GetString("EtcdPeers"), ",")
+		return NewFleetBackend(peers, viper.GetString("FleetPrefix"), mustParseDurationKey("EtcdTimeout"), mustParseDurationKey("FleetInterval"))
+	case "file":
+		return NewFileBackend(viper.GetString("UnitDir"), viper.GetString("MachinesFile"), mustParseDurationKey("FleetInterval")), nil
+	case "systemd":
+		return NewSystemdBackend(viper.GetString("HostAddress"))
+	}
+	return nil, fmt.Errorf("unknown backend '%s'", name)
+}
+
+func newHealthStore(name string) (HealthStore, error) {
+	switch name {
+	case "etcd":
+		peers := strings.Split(viper.GetString("EtcdPeers"), ",")
+		return NewEtcdHealthStore(peers, viper.GetString("HealthPrefix"), mustParseDurationKey("EtcdTimeout"))
+	}
+	return nil, fmt.Errorf("unknown health store '%s'", name)
+}
+
 func execute(cmd *cobra.Command, args []string) {
 	setupLogrus()
 	if !domainRx.MatchString(strings.ToLower(viper.GetString("Domain"))) {
 		log.Fatalln("invalid domain specified for Domain:", viper.GetString("Domain"))
 	}
-	peers := strings.Split(viper.GetString("EtcdPeers"), ",")
-	r, err := NewServiceRegistry(peers, viper.GetString("FleetPrefix"), mustParseDurationKey("EtcdTimeout"), registryOptions())
+	backend, err := newBackend(viper.GetString("Backend"))
 	if err != nil {
-		log.Fatalln("Failed to initialize fleet registry:", err)
+		log.Fatalf("Failed to initialize %s backend: %s\n", viper.GetString("Backend"), err.Error())
+	}
+	r := NewServiceRegistry(backend, registryOptions())
+	if viper.GetString("HealthStore") != "" {
+		store, err := newHealthStore(viper.GetString("HealthStore"))
+		if err != nil {
+			log.Fatalf("Failed to initialize %s health store: %s\n", viper.GetString("HealthStore"), err.Error())
+		}
+		r.SetHealthStore(store)
 	}
 	r.Start()
-	serveDns(r, viper.GetString("BindAddress"))
+	var forwarder *Forwarder
+	if viper.GetString("Upstreams") != "" {
+		forwarder = NewForwarder(viper.GetString("Upstreams"), mustParseDurationKey("UpstreamTimeout"))
+		log.Infoln("Forwarding queries outside of", viper.GetString("Domain"), "to", forwarder.Upstreams)
+	}
+	serveDns(r, viper.GetString("BindAddress"), forwarder)
 }
 
 func init() {
@@ -61,26 +122,62 @@ func init() {
 	mainCmd.PersistentFlags().Duration("check-timeout", time.Second*3, "Timeout for TCP and HTTP checks when unspecified in a unit file.")
 	mainCmd.PersistentFlags().UintP("check-concurrent", "c", 20, "Number of concurrent health checks to run.")
 	mainCmd.PersistentFlags().Duration("check-resolution", time.Second, "Maximum tick resolution for health check intervals.")
-	mainCmd.PersistentFlags().DurationP("fleet-interval", "i", time.Second*3, "Time to wait between polling fleet for service changes.")
+	mainCmd.PersistentFlags().Int("healthy-threshold", 1, "Consecutive passing rounds of health checks before a unit is served, when unspecified in a unit file.")
+	mainCmd.PersistentFlags().Int("unhealthy-threshold", 1, "Consecutive failing rounds of health checks before a unit stops being served, when unspecified in a unit file.")
+	mainCmd.PersistentFlags().Duration("unit-grace-period", 0, "Time to keep the health state of units that disappeared from the backend, in case they come back.")
+	mainCmd.PersistentFlags().String("health-store", "", "Share health checking with other watchdns replicas through a store, can be: 'etcd'. Every replica checks every unit when empty.")
+	mainCmd.PersistentFlags().String("health-prefix", "/watchdns", "Prefix for replicas and health reports in the etcd health store.")
+	mainCmd.PersistentFlags().String("replica-id", "", "Unique name of this replica in the health store, defaults to the hostname.")
+	mainCmd.PersistentFlags().Int("check-replicas", 2, "Number of replicas health checking each unit when using a health store.")
+	mainCmd.PersistentFlags().Duration("sync-interval", time.Second*5, "Time between reading the replicas and health reports from the health store.")
+	mainCmd.PersistentFlags().String("backend", "fleet", "Where to discover machines and units from, can be: 'fleet', 'file' or 'systemd'.")
+	mainCmd.PersistentFlags().DurationP("fleet-interval", "i", time.Second*3, "Time to wait between polling the backend for service changes.")
+	mainCmd.PersistentFlags().Bool("watch", true, "Watch the backend for changes instead of polling it every fleet-interval, if the backend supports it.")
+	mainCmd.PersistentFlags().Duration("reload-interval", time.Minute, "Time between full reloads of the backend while watching for changes.")
 	mainCmd.PersistentFlags().StringP("etcd-peers", "e", "http://localhost:4001", "Comma-delimited list of etcd peers to connect to.")
 	mainCmd.PersistentFlags().Duration("etcd-timeout", time.Second*5, "Timeout for etcd operations to complete.")
 	mainCmd.PersistentFlags().String("fleet-prefix", registry.DefaultKeyPrefix, "Prefix for fleet registry in etcd.")
+	mainCmd.PersistentFlags().String("unit-dir", "/etc/watchdns/units", "Directory of unit files for the file backend.")
+	mainCmd.PersistentFlags().String("machines-file", "/etc/watchdns/machines.toml", "List of machines and the units they run for the file backend.")
+	mainCmd.PersistentFlags().String("host-address", "", "Address of this host for the systemd backend, defaults to the first global unicast address.")
 	mainCmd.PersistentFlags().StringP("bind-address", "b", ":8053", "Bind address for the DNS responder.")
+	mainCmd.PersistentFlags().StringP("upstreams", "u", "", "Comma-delimited list of resolvers to forward queries outside of the watch domain to. Out of zone queries are refused when empty.")
+	mainCmd.PersistentFlags().Duration("upstream-timeout", time.Second*2, "Timeout for each attempt to query an upstream resolver.")
 	mainCmd.PersistentFlags().StringP("log-level", "l", "warn", "Log verbosity level, can be: 'debug', 'info', 'warn', 'error', or 'fatal'.")
 	mainCmd.PersistentFlags().StringP("log-format", "o", "ascii", "Log format, can be: 'ascii' or 'json'.")
-	mainCmd.PersistentFlags().StringP("record-sort", "s", "default", "Sort-order for DNS responses. Can be 'default', 'random', or 'roundrobin'")
+	mainCmd.PersistentFlags().Int("max-answers", 0, "Most addresses to answer a query with, picked according to record-sort, when unspecified in a unit file. 0 answers with all of them.")
+	mainCmd.PersistentFlags().Bool("reverse-services", false, "Answer PTR queries for machine addresses with the units running on them too, not only the machine.")
+	mainCmd.PersistentFlags().StringP("record-sort", "s", "default", "Sort-order for DNS responses. Can be 'default', 'random', 'roundrobin' or 'weighted' (by Srv priority and weight)")
 	viper.BindPFlag("Domain", mainCmd.PersistentFlags().Lookup("watch-domain"))
 	viper.BindPFlag("CheckInterval", mainCmd.PersistentFlags().Lookup("check-interval"))
 	viper.BindPFlag("CheckTimeout", mainCmd.PersistentFlags().Lookup("check-timeout"))
 	viper.BindPFlag("CheckConcurrent", mainCmd.PersistentFlags().Lookup("check-concurrent"))
 	viper.BindPFlag("CheckResolution", mainCmd.PersistentFlags().Lookup("check-resolution"))
+	viper.BindPFlag("HealthyThreshold", mainCmd.PersistentFlags().Lookup("healthy-threshold"))
+	viper.BindPFlag("UnhealthyThreshold", mainCmd.PersistentFlags().Lookup("unhealthy-threshold"))
+	viper.BindPFlag("UnitGracePeriod", mainCmd.PersistentFlags().Lookup("unit-grace-period"))
+	viper.BindPFlag("HealthStore", mainCmd.PersistentFlags().Lookup("health-store"))
+	viper.BindPFlag("HealthPrefix", mainCmd.PersistentFlags().Lookup("health-prefix"))
+	viper.BindPFlag("ReplicaId", mainCmd.PersistentFlags().Lookup("replica-id"))
+	viper.BindPFlag("CheckReplicas", mainCmd.PersistentFlags().Lookup("check-replicas"))
+	viper.BindPFlag("SyncInterval", mainCmd.PersistentFlags().Lookup("sync-interval"))
+	viper.BindPFlag("Backend", mainCmd.PersistentFlags().Lookup("backend"))
 	viper.BindPFlag("FleetInterval", mainCmd.PersistentFlags().Lookup("fleet-interval"))
+	viper.BindPFlag("Watch", mainCmd.PersistentFlags().Lookup("watch"))
+	viper.BindPFlag("ReloadInterval", mainCmd.PersistentFlags().Lookup("reload-interval"))
 	viper.BindPFlag("EtcdTimeout", mainCmd.PersistentFlags().Lookup("etcd-timeout"))
 	viper.BindPFlag("EtcdPeers", mainCmd.PersistentFlags().Lookup("etcd-peers"))
 	viper.BindPFlag("FleetPrefix", mainCmd.PersistentFlags().Lookup("fleet-prefix"))
+	viper.BindPFlag("UnitDir", mainCmd.PersistentFlags().Lookup("unit-dir"))
+	viper.BindPFlag("MachinesFile", mainCmd.PersistentFlags().Lookup("machines-file"))
+	viper.BindPFlag("HostAddress", mainCmd.PersistentFlags().Lookup("host-address"))
 	viper.BindPFlag("BindAddress", mainCmd.PersistentFlags().Lookup("bind-address"))
+	viper.BindPFlag("Upstreams", mainCmd.PersistentFlags().Lookup("upstreams"))
+	viper.BindPFlag("UpstreamTimeout", mainCmd.PersistentFlags().Lookup("upstream-timeout"))
 	viper.BindPFlag("LogLevel", mainCmd.PersistentFlags().Lookup("log-level"))
 	viper.BindPFlag("LogFormat", mainCmd.PersistentFlags().Lookup("log-format"))
+	viper.BindPFlag("MaxAnswers", mainCmd.PersistentFlags().Lookup("max-answers"))
+	viper.BindPFlag("ReverseServices", mainCmd.PersistentFlags().Lookup("reverse-services"))
 	viper.BindPFlag("RecordSort", mainCmd.PersistentFlags().Lookup("record-sort"))
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/watchdns/")
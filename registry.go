@@ -2,42 +2,67 @@ package main
 
 import (
 	"errors"
-	"github.com/coreos/fleet/etcd"
-	"github.com/coreos/fleet/registry"
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ServiceRegistry struct {
 	Options       RegistryOptions
-	etcd          etcd.Client
-	registry      *registry.EtcdRegistry
+	backend       Backend
 	endCh         chan bool
-	queryACh      chan QueryA
-	querySrvCh    chan QuerySrv
 	hRateCh       chan bool
 	domain        string
 	running       bool
 	units         map[string]*ServiceEntry
 	machineLookup map[string]net.IP
 	lookup        map[string][]*ServiceEntry
+	aliases       map[string][]*ServiceEntry
+	names         map[string]int
+	machineIps    map[string]string
+	checkRound    uint64
+	snapshot      atomic.Value
+	dirty         bool
+	store         HealthStore
+	reportLock    sync.Mutex
+	reports       map[string]healthReport
+	reportCh      chan struct{}
+	ring          *hashRing
+	reported      map[string]map[string]bool
 }
 
 type RegistryOptions struct {
 	Domain          string
 	CheckResolution time.Duration
 	FleetInterval   time.Duration
+	Watch           bool
+	ReloadInterval  time.Duration
 	CheckInterval   time.Duration
 	CheckTimeout    time.Duration
 	CheckConcurrent int
-	RecordSort      string
+	// defaults for units that don't set their own thresholds
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	UnitGracePeriod    time.Duration
+	RecordSort         string
+	// MaxAnswers limits the addresses in an answer, 0 for no limit
+	MaxAnswers int
+	// ReverseServices adds the units running on a machine to its PTR answers
+	ReverseServices bool
+	// ReplicaId, CheckReplicas and SyncInterval are only used when health
+	// checks are shared with other replicas through a HealthStore
+	ReplicaId     string
+	CheckReplicas int
+	SyncInterval  time.Duration
 }
 
 type ServiceEntry struct {
+	UnitName        string
+	MachineId       string
 	LastFleetCheck  time.Time
 	LastHealthCheck time.Time
 	UnitHash        string
@@ -45,60 +70,73 @@ type ServiceEntry struct {
 	Hostname            string
 	ServerAddress       net.IP
 	PendingHealthChecks int
+	PassedRounds        int
+	FailedRounds        int
+	CheckRound          uint64
+	RemovedAt           time.Time
 	FailedHealthChecks  int
+	CheckedOnline       bool
 	Online              bool
 	Running             bool
+	indexed             bool
 }
 
-type QuerySrv struct {
-	AnswerCh chan []AnswerSrv
-	Name     string
-	Service  string
-	Protocol string
-}
-type QueryA struct {
-	AnswerCh chan []AnswerA
-	Name     string
-}
 type AnswerSrv struct {
 	Target   string
 	TargetIP net.IP
 	SrvOption
 	Ttl time.Duration
 }
+
+// AnswerA holds a single address for a name, Server may be
+// either an IPv4 or an IPv6 address. Priority and Weight come from
+// the unit's Srv options and are used by the weighted RecordSort
 type AnswerA struct {
-	Server net.IP
+	Server   net.IP
+	Ttl      time.Duration
+	Priority uint16
+	Weight   uint16
+}
+
+// AnswerTxt holds the strings of a single TXT record
+type AnswerTxt struct {
+	Txt []string
+	Ttl time.Duration
+}
+
+// AnswerPtr holds a name an address maps back to
+type AnswerPtr struct {
+	Target string
+	Ttl    time.Duration
+}
+
+// AnswerCname holds the name an alias points to
+type AnswerCname struct {
+	Target string
 	Ttl    time.Duration
 }
 
+// HealthCheckResult is the outcome of a single check, Round identifies
+// the batch of checks it was started with so late results can be ignored
 type HealthCheckResult struct {
 	UnitId string
+	Round  uint64
 	Result bool
 }
 
-func NewServiceRegistry(etcdPeers []string, prefix string, timeout time.Duration, options *RegistryOptions) (*ServiceRegistry, error) {
-	log.Debugln("Using etcd peers:", etcdPeers)
-	cli, err := etcd.NewClient(etcdPeers, http.DefaultTransport.(*http.Transport), timeout)
-
-	if err != nil {
-		return nil, err
-	}
+func NewServiceRegistry(backend Backend, options *RegistryOptions) *ServiceRegistry {
 	s := new(ServiceRegistry)
-	s.etcd = cli
+	s.backend = backend
 	s.units = make(map[string]*ServiceEntry, 100)
 	s.Options = *options
-	log.Debugln("Using fleet prefix:", prefix)
-	s.registry = registry.NewEtcdRegistry(s.etcd, prefix)
-	return s, nil
+	return s
 }
 
 //Start monitoring services
 func (r *ServiceRegistry) Start() {
-	log.Info("Starting fleet and health check loop")
+	log.Info("Starting backend and health check loop")
 	r.hRateCh = make(chan bool, r.Options.CheckConcurrent)
 	r.endCh = make(chan bool)
-	r.queryACh = make(chan QueryA, 100)
-	r.querySrvCh = make(chan QuerySrv, 100)
 	go r.mainLoop(r.endCh)
 	<-r.endCh
 	r.running = true
@@ -111,116 +149,93 @@ func (r *ServiceRegistry) Stop() {
 }
 
 func (r *ServiceRegistry) mainLoop(endCh chan bool) {
-	fleetCh := time.NewTicker(r.Options.FleetInterval)
+	reloadInterval := r.Options.FleetInterval
+	backendEventCh := make(chan *BackendEvent, 100)
+	watchStopCh := make(chan struct{})
+	if wb, ok := r.backend.(WatchingBackend); ok && r.Options.Watch {
+		//start watching before the initial reload so nothing in between is missed
+		reloadInterval = r.Options.ReloadInterval
+		go wb.Watch(backendEventCh, watchStopCh)
+	}
+	viewCh := make(chan *clusterView)
+	if r.store != nil {
+		go r.syncCluster(viewCh, watchStopCh)
+	}
+	reloadCh := time.NewTicker(reloadInterval)
 	healthCh := time.NewTicker(r.Options.CheckResolution)
 	healthResultsCh := make(chan HealthCheckResult, 100)
-	r.reloadFleet()
+	r.reloadBackend()
+	r.publish()
 	endCh <- true //signal that we finished the initial reload
 	for {
 		select {
 		case <-endCh:
-			fleetCh.Stop()
+			reloadCh.Stop()
 			healthCh.Stop()
+			close(watchStopCh)
 			break
-		case <-fleetCh.C:
-			r.reloadFleet()
+		case <-reloadCh.C:
+			r.reloadBackend()
+		case ev := <-backendEventCh:
+			if ev == nil {
+				r.reloadBackend()
+			} else {
+				r.processBackendEvent(ev)
+			}
 		case <-healthCh.C:
 			r.doHealthChecks(healthResultsCh)
 		case result := <-healthResultsCh:
 			r.processHealthCheckResult(result)
-		case queryA := <-r.queryACh:
-			r.doLookupA(queryA)
-		case querySrv := <-r.querySrvCh:
-			r.doLookupSrv(querySrv)
+		case v := <-viewCh:
+			r.applyClusterView(v)
 		}
-	}
-}
-
-func (r *ServiceRegistry) LookupA(name string) []AnswerA {
-	ch := make(chan []AnswerA, 1)
-	r.queryACh <- QueryA{ch, name}
-	ans := <-ch
-	close(ch)
-	return ans
-}
-func (r *ServiceRegistry) LookupSrv(name, service, protocol string) []AnswerSrv {
-	ch := make(chan []AnswerSrv, 1)
-	r.querySrvCh <- QuerySrv{ch, name, service, protocol}
-	ans := <-ch
-	close(ch)
-	return ans
-}
-
-func (r *ServiceRegistry) doLookupA(q QueryA) {
-	if strings.HasSuffix(q.Name, ".machine."+r.Options.Domain) {
-		addr := r.machineLookup[q.Name]
-		if addr != nil {
-			q.AnswerCh <- []AnswerA{{addr, r.Options.FleetInterval}}
-		} else {
-			q.AnswerCh <- []AnswerA{}
-		}
-		return
-	}
-	entries := r.lookup[q.Name]
-	if entries == nil || len(entries) == 0 {
-		q.AnswerCh <- []AnswerA{}
-		return
-	}
-	ans := make([]AnswerA, 0, len(entries))
-	for _, e := range entries {
-		if e.Running && e.Online && e.ServerAddress != nil {
-			ans = append(ans, AnswerA{e.ServerAddress, e.CheckInterval})
+		//results tend to arrive in bursts, publish once the burst is handled
+		if r.dirty && len(healthResultsCh) == 0 {
+			r.publish()
 		}
 	}
-	q.AnswerCh <- ans
-}
-func (r *ServiceRegistry) doLookupSrv(q QuerySrv) {
-	entries := r.lookup[q.Name]
-	if entries == nil || len(entries) == 0 {
-		q.AnswerCh <- []AnswerSrv{}
-		return
-	}
-	ans := make([]AnswerSrv, 0, len(entries)*3)
-	for _, e := range entries {
-		if !e.Running || !e.Online || e.ServerAddress == nil {
-			continue
-		}
-		for _, s := range e.SrvOptions {
-			if s.Service != q.Service || s.Protocol != q.Protocol {
-				continue
-			}
-			ans = append(ans, AnswerSrv{e.Hostname, e.ServerAddress, *s, e.CheckInterval})
-		}
-	}
-	q.AnswerCh <- ans
 }
 
 func (r *ServiceRegistry) processHealthCheckResult(h HealthCheckResult) {
 	entry := r.units[h.UnitId]
-	if entry == nil {
+	//results for removed units, or from before a unit was re-added, are stale
+	if entry == nil || entry.CheckRound != h.Round {
 		return
 	}
 	entry.PendingHealthChecks -= 1
-	//a single failure immediately marks it as offline
+	//the first failure fails the round, so there's no need to wait for the rest
 	if h.Result == false {
-		if entry.Online {
-			log.Info("Unit failed health check:", h.UnitId)
-		}
-		entry.Online = false
 		entry.FailedHealthChecks += 1
+		if entry.FailedHealthChecks == 1 {
+			entry.PassedRounds = 0
+			entry.FailedRounds += 1
+			if entry.CheckedOnline && entry.FailedRounds >= entry.UnhealthyThreshold {
+				log.Info("Unit failed health check:", h.UnitId)
+				entry.CheckedOnline = false
+			}
+			r.serveCheckedHealth(entry)
+			r.reportHealth(h.UnitId, entry)
+		}
 	} else if entry.PendingHealthChecks == 0 && entry.FailedHealthChecks == 0 {
-		entry.Online = true
+		entry.FailedRounds = 0
+		entry.PassedRounds += 1
+		if !entry.CheckedOnline && entry.PassedRounds >= entry.HealthyThreshold {
+			log.Info("Unit passed health check:", h.UnitId)
+			entry.CheckedOnline = true
+		}
+		r.serveCheckedHealth(entry)
+		r.reportHealth(h.UnitId, entry)
 	}
 }
 
 func (r *ServiceRegistry) updateEntry(unitName, machineId, machineIp string, entry *ServiceEntry) error {
 	log.Debugln("Updating unit: " + unitName + ":" + machineId)
-	u, err := r.registry.Unit(unitName)
+	opts, err := r.backend.UnitOptions(unitName)
 	if err != nil {
-		log.Warn("Could not read unit from fleet:", err)
+		log.Warn("Could not read unit from backend:", err)
 		return err
 	}
-	if u == nil {
+	if opts == nil {
 		return errors.New("unit data missing")
 	}
 	vars := new(UnitVars)
@@ -228,75 +243,287 @@ func (r *ServiceRegistry) updateEntry(unitName, machineId, machineIp string, ent
 	vars.PrefixName, vars.InstanceName, _ = parseUnitName(unitName)
 	vars.UnitName = unitName
 	vars.MachineId = machineId
-	svc := vars.ServiceOption(r.Options, u.Unit.Options)
+	svc := vars.ServiceOption(r.Options, opts)
 
 	entry.ServiceOption = *svc
 	return nil
 }
 
-func (r *ServiceRegistry) reloadFleet() {
-	machines, err := r.registry.Machines()
+// reloadBackend reads every machine and unit state from the backend and
+// rebuilds the lookup tables from scratch, when watching the backend this
+// is only a safety net for events that were missed
+func (r *ServiceRegistry) reloadBackend() {
+	machines, err := r.backend.Machines()
 	if err != nil {
 		log.Warn("Failed to get list of machines:", err)
 		return
 	}
 	//new services should be set with random offset for check times (so not all checks run at once)
-	units, err := r.registry.UnitStates()
+	units, err := r.backend.UnitStates()
 	if err != nil {
 		log.Warn("Failed to get list of units:", err)
 		return
 	}
-	ips := make(map[string]string, len(machines))
+	r.dirty = true
+	r.machineIps = make(map[string]string, len(machines))
 	r.machineLookup = make(map[string]net.IP, len(machines)*2)
+	r.lookup = make(map[string][]*ServiceEntry, len(units)*3)
+	r.aliases = make(map[string][]*ServiceEntry)
+	r.names = make(map[string]int, len(machines)*2+len(units)*3)
+	r.addName(r.Options.Domain)
+	for _, entry := range r.units {
+		entry.indexed = false
+	}
 	for _, v := range machines {
-		ip := net.ParseIP(v.PublicIP)
-		r.machineLookup["m-"+v.ShortID()+".machine."+r.Options.Domain] = ip
-		r.machineLookup["m-"+v.ID+".machine."+r.Options.Domain] = ip
-		ips[v.ID] = v.PublicIP
+		r.setMachine(v.ID, v.PublicIP)
 	}
-
-	r.lookup = make(map[string][]*ServiceEntry, len(units)*3)
+	seen := make(map[string]bool, len(units))
 	for _, v := range units {
-		var entry *ServiceEntry
-		if r.units[v.UnitName+":"+v.MachineID] != nil {
-			entry = r.units[v.UnitName+":"+v.MachineID]
-			if entry.UnitHash != v.UnitHash {
-				err := r.updateEntry(v.UnitName, v.MachineID, ips[v.MachineID], entry)
-				if err != nil {
-					continue
-				}
+		r.applyUnitState(v)
+		seen[v.UnitName+":"+v.MachineID] = true
+	}
+	for id, entry := range r.units {
+		if !seen[id] {
+			r.removeEntry(entry)
+		}
+	}
+	r.collectEntries()
+}
+
+// setMachine updates the machine lookup for a single machine,
+// an empty publicIp removes the machine
+func (r *ServiceRegistry) setMachine(id, publicIp string) {
+	short := "m-" + shortMachineId(id) + ".machine." + r.Options.Domain
+	full := "m-" + id + ".machine." + r.Options.Domain
+	if _, ok := r.machineIps[id]; ok {
+		delete(r.machineLookup, short)
+		delete(r.machineLookup, full)
+		r.removeName(short)
+		r.removeName(full)
+		delete(r.machineIps, id)
+	}
+	if publicIp == "" {
+		return
+	}
+	ip := net.ParseIP(publicIp)
+	r.machineLookup[short] = ip
+	r.machineLookup[full] = ip
+	r.addName(short)
+	r.addName(full)
+	r.machineIps[id] = publicIp
+}
+
+// processBackendEvent applies a single change reported by a watching backend
+func (r *ServiceRegistry) processBackendEvent(ev *BackendEvent) {
+	if ev.Machine != nil && !ev.Removed {
+		if ip, ok := r.machineIps[ev.Machine.ID]; ok && ip == ev.Machine.PublicIP {
+			//machines are refreshed constantly, most of the time nothing changes
+			return
+		}
+	}
+	r.dirty = true
+	switch {
+	case ev.Machine != nil && ev.Removed:
+		r.setMachine(ev.Machine.ID, "")
+	case ev.Machine != nil:
+		r.setMachine(ev.Machine.ID, ev.Machine.PublicIP)
+		for _, entry := range r.units {
+			if entry.MachineId == ev.Machine.ID && entry.indexed {
+				r.applyUnitState(&UnitState{entry.UnitName, entry.MachineId, entry.UnitHash, activeState(entry)})
 			}
-		} else {
-			entry = new(ServiceEntry)
-			r.units[v.UnitName+":"+v.MachineID] = entry
-			err := r.updateEntry(v.UnitName, v.MachineID, ips[v.MachineID], entry)
-			if err != nil {
-				continue
+		}
+	case ev.UnitState != nil && ev.Removed:
+		r.removeUnitState(ev.UnitState.UnitName, ev.UnitState.MachineID)
+	case ev.UnitState != nil:
+		r.applyUnitState(ev.UnitState)
+	}
+}
+
+func activeState(entry *ServiceEntry) string {
+	if entry.Running {
+		return "active"
+	}
+	return "inactive"
+}
+
+// applyUnitState brings the entry for a single unit state up to date,
+// re-reading the unit file only when it (or the machine address) changed
+func (r *ServiceRegistry) applyUnitState(v *UnitState) {
+	id := v.UnitName + ":" + v.MachineID
+	entry := r.units[id]
+	ip := net.ParseIP(r.machineIps[v.MachineID])
+	added := entry == nil
+	changed := added || entry.UnitHash != v.UnitHash || !entry.ServerAddress.Equal(ip)
+	if added {
+		entry = new(ServiceEntry)
+		entry.UnitName = v.UnitName
+		entry.MachineId = v.MachineID
+		r.units[id] = entry
+	}
+	r.unindexEntry(entry)
+	entry.RemovedAt = time.Time{}
+	if changed {
+		err := r.updateEntry(v.UnitName, v.MachineID, r.machineIps[v.MachineID], entry)
+		if err != nil {
+			//keep serving what we had, the old hash makes the next update retry
+			if added {
+				delete(r.units, id)
+			} else {
+				r.indexEntry(entry)
 			}
+			return
 		}
-		entry.UnitHash = v.UnitHash
-		entry.Hostname = "m-" + v.MachineID + ".machine." + r.Options.Domain
-		entry.ServerAddress = net.ParseIP(ips[v.MachineID])
-		if v.ActiveState == "active" {
-			entry.Running = true
-		} else {
-			entry.Running = false
+	}
+	entry.UnitHash = v.UnitHash
+	entry.Hostname = "m-" + v.MachineID + ".machine." + r.Options.Domain
+	entry.ServerAddress = ip
+	if v.ActiveState == "active" {
+		entry.Running = true
+	} else {
+		entry.Running = false
+	}
+	r.indexEntry(entry)
+}
+
+// removeUnitState takes units that the backend no longer reports out of the lookup
+// tables, an empty machineId removes the unit from every machine
+func (r *ServiceRegistry) removeUnitState(unitName, machineId string) {
+	for _, entry := range r.units {
+		if entry.UnitName != unitName || (machineId != "" && entry.MachineId != machineId) {
+			continue
+		}
+		r.removeEntry(entry)
+	}
+	r.collectEntries()
+}
+
+// removeEntry takes an entry out of the lookup tables and stops checking it,
+// it is forgotten once UnitGracePeriod passes without it coming back
+func (r *ServiceRegistry) removeEntry(entry *ServiceEntry) {
+	r.unindexEntry(entry)
+	entry.Running = false
+	//forget about checks in flight, their results are ignored
+	entry.PendingHealthChecks = 0
+	entry.CheckRound = 0
+	if entry.RemovedAt.IsZero() {
+		log.Debugln("Unit removed:", entry.UnitName+":"+entry.MachineId)
+		entry.RemovedAt = time.Now()
+	}
+}
+
+// collectEntries drops removed entries past their grace period, pending
+// health check results for them are ignored when they arrive
+func (r *ServiceRegistry) collectEntries() {
+	for id, entry := range r.units {
+		if !entry.RemovedAt.IsZero() && time.Since(entry.RemovedAt) >= r.Options.UnitGracePeriod {
+			delete(r.units, id)
 		}
+	}
+}
+
+// entryNames returns every name an entry answers to
+func (r *ServiceRegistry) entryNames(entry *ServiceEntry) []string {
+	names := make([]string, 0, 1+len(entry.Tags)+len(entry.SrvOptions))
+	names = append(names, entry.Name+".service."+r.Options.Domain)
+	for _, t := range entry.Tags {
+		names = append(names, t+"."+entry.Name+".service."+r.Options.Domain)
+	}
+	for _, s := range entry.SrvOptions {
+		names = append(names, "_"+s.Service+"._"+s.Protocol+"."+r.Options.Domain)
+	}
+	return names
+}
 
-		r.addToLookupTable(entry.Name+".service."+r.Options.Domain, entry)
-		for _, t := range entry.Tags {
-			r.addToLookupTable(t+"."+entry.Name+".service."+r.Options.Domain, entry)
+// indexEntry adds all of the names an entry answers to into the lookup table
+func (r *ServiceRegistry) indexEntry(entry *ServiceEntry) {
+	if entry.indexed {
+		return
+	}
+	for _, fqdn := range r.entryNames(entry) {
+		r.addToTable(r.lookup, fqdn, entry)
+	}
+	for _, fqdn := range entry.Aliases {
+		for _, e := range r.aliases[fqdn] {
+			if e.Name != entry.Name {
+				log.Warnf("Alias %s is claimed by units %s and %s, the lowest unit name keeps it\n", fqdn, e.UnitName, entry.UnitName)
+				break
+			}
 		}
-		for _, s := range entry.SrvOptions {
-			r.addToLookupTable("_"+s.Service+"._"+s.Protocol+"."+r.Options.Domain, entry)
+		r.addToTable(r.aliases, fqdn, entry)
+	}
+	entry.indexed = true
+}
+
+// unindexEntry removes an entry from the lookup table, it must be called
+// before any of the options that make up its names are changed
+func (r *ServiceRegistry) unindexEntry(entry *ServiceEntry) {
+	if !entry.indexed {
+		return
+	}
+	for _, fqdn := range r.entryNames(entry) {
+		r.removeFromTable(r.lookup, fqdn, entry)
+	}
+	for _, fqdn := range entry.Aliases {
+		r.removeFromTable(r.aliases, fqdn, entry)
+	}
+	entry.indexed = false
+}
+
+// addToTable adds entry under fqdn to either the lookup or the alias table
+func (r *ServiceRegistry) addToTable(table map[string][]*ServiceEntry, fqdn string, entry *ServiceEntry) {
+	if table[fqdn] == nil {
+		table[fqdn] = make([]*ServiceEntry, 0, 10)
+	}
+	table[fqdn] = append(table[fqdn], entry)
+	r.addName(fqdn)
+}
+
+func (r *ServiceRegistry) removeFromTable(table map[string][]*ServiceEntry, fqdn string, entry *ServiceEntry) {
+	entries := table[fqdn]
+	for i, e := range entries {
+		if e == entry {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
 		}
 	}
+	if len(entries) == 0 {
+		delete(table, fqdn)
+	} else {
+		table[fqdn] = entries
+	}
+	r.removeName(fqdn)
+}
+
+// addName records fqdn and every name between it and the domain
+// as existing, so empty non-terminals get NODATA instead of NXDOMAIN
+func (r *ServiceRegistry) addName(fqdn string) {
+	r.countName(fqdn, 1)
+}
+func (r *ServiceRegistry) removeName(fqdn string) {
+	r.countName(fqdn, -1)
 }
-func (r *ServiceRegistry) addToLookupTable(fqdn string, entry *ServiceEntry) {
-	if r.lookup[fqdn] == nil {
-		r.lookup[fqdn] = make([]*ServiceEntry, 0, 10)
+
+// countName keeps a reference count for fqdn and its parents,
+// names are dropped once nothing refers to them
+func (r *ServiceRegistry) countName(fqdn string, n int) {
+	fqdn = strings.ToLower(fqdn)
+	for {
+		r.names[fqdn] += n
+		if r.names[fqdn] <= 0 {
+			delete(r.names, fqdn)
+		}
+		if !dns.IsSubDomain(r.Options.Domain, fqdn) || dns.CountLabel(fqdn) <= dns.CountLabel(r.Options.Domain) {
+			return
+		}
+		i, _ := dns.NextLabel(fqdn, 0)
+		fqdn = fqdn[i:]
 	}
-	r.lookup[fqdn] = append(r.lookup[fqdn], entry)
+}
+
+// healthCheckCount is the number of checks in a round for the entry
+func (e *ServiceEntry) healthCheckCount() int {
+	return len(e.CheckHttp) + len(e.CheckTcp) + len(e.CheckExec) + len(e.CheckDns) +
+		len(e.CheckUdp) + len(e.CheckGrpc) + len(e.CheckTls)
 }
 
 // doHealthChecks fires off all pending health checks (with expired timers)
@@ -306,6 +533,10 @@ func (r *ServiceRegistry) addToLookupTable(fqdn string, entry *ServiceEntry) {
 // queries and other things
 func (r *ServiceRegistry) doHealthChecks(resultCh chan HealthCheckResult) {
 	for id, entry := range r.units {
+		//units that are gone (but still within the grace period) aren't checked
+		if !entry.RemovedAt.IsZero() {
+			continue
+		}
 		//only start health checks if we are at or past the interval
 		if time.Now().Sub(entry.LastHealthCheck) < entry.CheckInterval {
 			continue
@@ -315,51 +546,116 @@ func (r *ServiceRegistry) doHealthChecks(resultCh chan HealthCheckResult) {
 			continue
 		}
 		entry.LastHealthCheck = time.Now()
+		r.checkRound++
+		entry.CheckRound = r.checkRound
 		entry.FailedHealthChecks = 0
-		entry.PendingHealthChecks = len(entry.CheckHttp) + len(entry.CheckTcp)
+		entry.PendingHealthChecks = entry.healthCheckCount()
 		//short-circuit if there are no health checks
 		if entry.PendingHealthChecks == 0 {
+			r.dirty = r.dirty || !entry.Online
+			entry.CheckedOnline = true
 			entry.Online = true
 			continue
 		}
-		for _, u := range entry.CheckHttp {
-			go r.checkHttp(u.String(), id, resultCh)
+		//other replicas check this unit and report back
+		if !r.ownsUnit(id) {
+			entry.PendingHealthChecks = 0
+			continue
+		}
+		for _, c := range entry.CheckHttp {
+			go r.checkHttp(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
 		}
 		for _, a := range entry.CheckTcp {
-			go r.checkTcp(a.String(), id, resultCh)
+			go r.checkTcp(a.String(), entry.CheckTimeout, id, entry.CheckRound, resultCh)
+		}
+		for _, c := range entry.CheckExec {
+			go r.checkExec(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
+		}
+		for _, c := range entry.CheckDns {
+			go r.checkDns(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
+		}
+		for _, c := range entry.CheckUdp {
+			go r.checkUdp(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
+		}
+		for _, c := range entry.CheckGrpc {
+			go r.checkGrpc(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
+		}
+		for _, c := range entry.CheckTls {
+			go r.checkTls(c, entry.CheckTimeout, id, entry.CheckRound, resultCh)
 		}
 	}
 }
 
-func (r *ServiceRegistry) checkHttp(url string, unitId string, resultCh chan HealthCheckResult) {
+func (r *ServiceRegistry) checkHttp(check *HttpCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
 	r.hRateCh <- true
-	cli := http.Client{Timeout: r.Options.CheckTimeout}
-	resp, err := cli.Get(url)
+	err := check.Check(timeout)
 	if err != nil {
-		resultCh <- HealthCheckResult{unitId, false}
-		goto done
+		log.Debugf("HTTP check %s for %s failed: %s\n", check, unitId, err.Error())
 	}
-	ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if resp.StatusCode/100 == 2 {
-		resultCh <- HealthCheckResult{unitId, true}
-	} else {
-		resultCh <- HealthCheckResult{unitId, false}
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
+	<-r.hRateCh
+}
+
+func (r *ServiceRegistry) checkExec(check *ExecCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
+	r.hRateCh <- true
+	out, err := check.Check(timeout)
+	if err != nil {
+		log.Debugf("Exec check '%s' for %s failed: %s, output: %s\n", check, unitId, err.Error(), out)
 	}
-done:
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
+	<-r.hRateCh
+}
+
+func (r *ServiceRegistry) checkDns(check *DnsCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
+	r.hRateCh <- true
+	err := check.Check(timeout)
+	if err != nil {
+		log.Debugf("DNS check %s for %s failed: %s\n", check, unitId, err.Error())
+	}
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
+	<-r.hRateCh
+}
+
+func (r *ServiceRegistry) checkUdp(check *UdpCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
+	r.hRateCh <- true
+	err := check.Check(timeout)
+	if err != nil {
+		log.Debugf("UDP check %s for %s failed: %s\n", check, unitId, err.Error())
+	}
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
+	<-r.hRateCh
+}
+
+func (r *ServiceRegistry) checkGrpc(check *GrpcCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
+	r.hRateCh <- true
+	err := check.Check(timeout)
+	if err != nil {
+		log.Debugf("gRPC check %s for %s failed: %s\n", check, unitId, err.Error())
+	}
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
+	<-r.hRateCh
+}
+
+func (r *ServiceRegistry) checkTls(check *TlsCheck, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
+	r.hRateCh <- true
+	err := check.Check(timeout)
+	if err != nil {
+		log.Debugf("TLS check %s for %s failed: %s\n", check, unitId, err.Error())
+	}
+	resultCh <- HealthCheckResult{unitId, round, err == nil}
 	<-r.hRateCh
 }
 
-func (r *ServiceRegistry) checkTcp(address string, unitId string, resultCh chan HealthCheckResult) {
+func (r *ServiceRegistry) checkTcp(address string, timeout time.Duration, unitId string, round uint64, resultCh chan HealthCheckResult) {
 	r.hRateCh <- true
-	conn, err := net.DialTimeout("tcp", address, r.Options.CheckTimeout)
+	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
-		resultCh <- HealthCheckResult{unitId, false}
+		resultCh <- HealthCheckResult{unitId, round, false}
 		goto done
 	}
 
 	conn.Close()
-	resultCh <- HealthCheckResult{unitId, true}
+	resultCh <- HealthCheckResult{unitId, round, true}
 done:
 	<-r.hRateCh
 }
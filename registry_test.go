@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeBackend serves whatever machines and units a test puts into it
+type fakeBackend struct {
+	machines []*Machine
+	states   []*UnitState
+	units    map[string][]*unit.UnitOption
+	reads    int
+}
+
+func (f *fakeBackend) Machines() ([]*Machine, error)     { return f.machines, nil }
+func (f *fakeBackend) UnitStates() ([]*UnitState, error) { return f.states, nil }
+func (f *fakeBackend) UnitOptions(unitName string) ([]*unit.UnitOption, error) {
+	f.reads++
+	return f.units[unitName], nil
+}
+
+func TestServiceRegistry_ReloadBackend(t *testing.T) {
+	b := &fakeBackend{
+		machines: []*Machine{{"abcdef0123456789", "10.0.0.5"}, {"0123456789abcdef", "10.0.0.6"}},
+		states: []*UnitState{
+			{"web@1.service", "abcdef0123456789", "h1", "active"},
+			{"web@2.service", "0123456789abcdef", "h1", "active"},
+		},
+		units: map[string][]*unit.UnitOption{
+			"web@1.service": {unit.NewUnitOption("X-Watchdns", "Srv", "http:tcp:80")},
+			"web@2.service": {unit.NewUnitOption("X-Watchdns", "Srv", "http:tcp:80")},
+		},
+	}
+	r := newTestRegistry()
+	r.backend = b
+	r.reloadBackend()
+	//units without health checks come online with the first round
+	r.doHealthChecks(make(chan HealthCheckResult))
+	r.publish()
+	assert.Equal(t, 2, b.reads)
+	assert.Len(t, r.LookupA("web.service.watchdns."), 2)
+	assert.Len(t, r.LookupA("i-1.web.service.watchdns."), 1)
+	assert.Len(t, r.LookupSrv("_http._tcp.watchdns.", "http", "tcp"), 2)
+	assert.Len(t, r.LookupA("m-01234567.machine.watchdns."), 1)
+
+	//unchanged units aren't read again
+	b.states = b.states[:1]
+	r.reloadBackend()
+	r.publish()
+	assert.Equal(t, 2, b.reads)
+	assert.Len(t, r.LookupA("web.service.watchdns."), 1)
+	assert.False(t, r.LookupName("i-2.web.service.watchdns."))
+}
+
+func TestServiceRegistry_UpdateFailure(t *testing.T) {
+	b := &fakeBackend{
+		machines: []*Machine{{"abcdef0123456789", "10.0.0.5"}},
+		states:   []*UnitState{{"web@1.service", "abcdef0123456789", "h1", "active"}},
+		units:    map[string][]*unit.UnitOption{"web@1.service": {}},
+	}
+	r := newTestRegistry()
+	r.backend = b
+	r.reloadBackend()
+	assert.Len(t, r.units, 1)
+
+	//a unit that can't be read keeps its old definition until it can
+	delete(b.units, "web@1.service")
+	b.states = []*UnitState{{"web@1.service", "abcdef0123456789", "h2", "active"}, {"web@2.service", "abcdef0123456789", "h1", "active"}}
+	r.reloadBackend()
+	r.publish()
+	assert.True(t, r.LookupName("i-1.web.service.watchdns."))
+	assert.Equal(t, "h1", r.units["web@1.service:abcdef0123456789"].UnitHash)
+	//and one that was never read isn't kept around at all
+	assert.Nil(t, r.units["web@2.service:abcdef0123456789"])
+
+	b.units["web@1.service"] = []*unit.UnitOption{}
+	r.reloadBackend()
+	assert.Equal(t, "h2", r.units["web@1.service:abcdef0123456789"].UnitHash)
+}
+
+func TestServiceRegistry_CollectEntries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := &fakeBackend{
+		machines: []*Machine{{"abcdef0123456789", "127.0.0.1"}},
+		states: []*UnitState{
+			{"web@1.service", "abcdef0123456789", "h1", "active"},
+			{"web@2.service", "abcdef0123456789", "h1", "active"},
+		},
+		units: map[string][]*unit.UnitOption{
+			"web@1.service": {unit.NewUnitOption("X-Watchdns", "CheckTcp", l.Addr().String())},
+			"web@2.service": {},
+		},
+	}
+	r := newTestRegistry()
+	r.backend = b
+	r.hRateCh = make(chan bool, 1)
+	r.Options.CheckTimeout = time.Second
+	r.Options.UnitGracePeriod = time.Hour
+	r.reloadBackend()
+	resultCh := make(chan HealthCheckResult, 1)
+	r.doHealthChecks(resultCh)
+	stale := <-resultCh
+
+	//gone units stay around during the grace period, but aren't checked or served
+	b.states = b.states[1:]
+	r.reloadBackend()
+	r.publish()
+	assert.Len(t, r.units, 2)
+	e := r.units["web@1.service:abcdef0123456789"]
+	assert.False(t, e.RemovedAt.IsZero())
+	assert.False(t, r.LookupName("i-1.web.service.watchdns."))
+	r.processHealthCheckResult(stale)
+	assert.False(t, e.Online, "results from before removal are ignored")
+	e.LastHealthCheck = time.Time{}
+	r.doHealthChecks(resultCh)
+	assert.Equal(t, 0, e.PendingHealthChecks)
+
+	//coming back within the grace period keeps the entry
+	b.states = append(b.states, &UnitState{"web@1.service", "abcdef0123456789", "h1", "active"})
+	r.reloadBackend()
+	assert.True(t, e.RemovedAt.IsZero())
+	assert.Equal(t, e, r.units["web@1.service:abcdef0123456789"])
+	r.doHealthChecks(resultCh)
+	r.processHealthCheckResult(<-resultCh)
+	assert.True(t, e.Online)
+
+	r.Options.UnitGracePeriod = 0
+	b.states = b.states[:1]
+	r.reloadBackend()
+	assert.Len(t, r.units, 1)
+	assert.Nil(t, r.units["web@1.service:abcdef0123456789"])
+}
+
+func TestServiceRegistry_HealthThresholds(t *testing.T) {
+	e := testEntry("web", "10.0.0.1", false)
+	e.HealthyThreshold = 2
+	e.UnhealthyThreshold = 2
+	r := newTestRegistry(e)
+	round := func(results ...bool) {
+		r.checkRound++
+		e.CheckRound = r.checkRound
+		e.FailedHealthChecks = 0
+		e.PendingHealthChecks = len(results)
+		for _, res := range results {
+			r.processHealthCheckResult(HealthCheckResult{"a", e.CheckRound, res})
+		}
+	}
+
+	round(true, true)
+	assert.False(t, e.Online, "one passing round is not enough")
+	round(true, false)
+	round(true, true)
+	assert.False(t, e.Online, "a failing round resets the count")
+	round(true, true)
+	assert.True(t, e.Online)
+
+	round(false, false)
+	assert.True(t, e.Online, "one failing round is not enough")
+	assert.Equal(t, 1, e.FailedRounds)
+	round(true, true)
+	round(false, true)
+	assert.True(t, e.Online, "a passing round resets the count")
+	round(false, true)
+	assert.False(t, e.Online)
+	assert.True(t, r.dirty)
+}
+
+func TestServiceRegistry_CheckTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	r := newTestRegistry()
+	r.hRateCh = make(chan bool, 1)
+	r.Options.CheckTimeout = time.Minute
+	resultCh := make(chan HealthCheckResult, 1)
+
+	check, _ := parseHttpCheck(srv.URL)
+	//the per-unit timeout wins over the global one
+	r.checkHttp(check, 50*time.Millisecond, "a", 1, resultCh)
+	assert.False(t, (<-resultCh).Result)
+	r.checkHttp(check, time.Second, "a", 1, resultCh)
+	assert.True(t, (<-resultCh).Result)
+}
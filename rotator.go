@@ -0,0 +1,31 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// rotatorSlots bounds the memory used for round robin, names hashing to
+// the same slot share a counter which only makes their rotation jump ahead
+const rotatorSlots = 4096
+
+// rotator hands out round robin offsets per name and type. ServeDNS is
+// called from many goroutines at once, so the counters are only touched
+// atomically, and a fixed number of them keeps it bounded however many
+// names are queried.
+type rotator struct {
+	counts [rotatorSlots]uint32
+}
+
+// next returns the offset to rotate n answers to name by, moving it along
+// for the next query
+func (r *rotator) next(name string, qtype uint16, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{byte(qtype >> 8), byte(qtype)})
+	count := atomic.AddUint32(&r.counts[h.Sum32()%rotatorSlots], 1) - 1
+	return int(count % uint32(n))
+}
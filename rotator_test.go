@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestRotator_Next(t *testing.T) {
+	r := new(rotator)
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, i%3, r.next("web.service.watchdns.", dns.TypeA, 3))
+	}
+	//other types of the same name have their own counter
+	assert.Equal(t, 0, r.next("web.service.watchdns.", dns.TypeAAAA, 3))
+	assert.Equal(t, 0, r.next("web.service.watchdns.", dns.TypeA, 0))
+}
+
+// TestDnsServer_RoundRobinConcurrent is meant to be run with -race
+func TestDnsServer_RoundRobinConcurrent(t *testing.T) {
+	entries := make([]*ServiceEntry, 0, 8)
+	for i := 0; i < 4; i++ {
+		entries = append(entries, testEntry("web", fmt.Sprintf("10.0.0.%d", i+1), true))
+		entries = append(entries, testEntry("web", fmt.Sprintf("2001:db8::%d", i+1), true))
+	}
+	r := newTestRegistry(entries...)
+	r.Options.RecordSort = "roundrobin"
+	d := newDnsServer(r, nil)
+
+	var lock sync.Mutex
+	first := make(map[string]int)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			qtype := dns.TypeA
+			if g%2 == 1 {
+				qtype = dns.TypeAAAA
+			}
+			for i := 0; i < 100; i++ {
+				m := query(d, "web.service.watchdns.", qtype)
+				if !assert.Len(t, m.Answer, 4) {
+					return
+				}
+				lock.Lock()
+				first[m.Answer[0].String()]++
+				lock.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	//800 queries of each type spread over 4 addresses each
+	assert.Len(t, first, 8)
+	for rr, n := range first {
+		assert.Equal(t, 200, n, rr)
+	}
+}
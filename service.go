@@ -5,9 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit" //this is why you don't embed dependencies
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"net"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -33,10 +33,30 @@ type ServiceOption struct {
 	Name          string
 	Tags          []string
 	SrvOptions    []*SrvOption
-	CheckHttp     []*url.URL
+	CheckHttp     []*HttpCheck
 	CheckTcp      []*net.TCPAddr
+	CheckExec     []*ExecCheck
+	CheckDns      []*DnsCheck
+	CheckUdp      []*UdpCheck
+	CheckGrpc     []*GrpcCheck
+	CheckTls      []*TlsCheck
 	CheckInterval time.Duration
 	CheckTimeout  time.Duration
+	// HealthyThreshold and UnhealthyThreshold are the number of consecutive
+	// passing or failing rounds of checks needed to change state
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	// Backup is the unit's failover tier, 0 for primaries. A tier is only
+	// answered with when every unit in the tiers before it is down
+	Backup int
+	// MaxAnswers limits the addresses answered for the unit's names, 0
+	// for no limit. The smallest limit of the units behind a name is used
+	MaxAnswers int
+	// Aliases are names under the domain answered with a CNAME to the
+	// unit's service name
+	Aliases []string
+	// Txt are the strings of the unit's TXT record, one per Txt key
+	Txt []string
 }
 
 func parseUnitName(name string) (prefix, instance, unitType string) {
@@ -86,6 +106,65 @@ func parseSrvOption(val string) (*SrvOption, error) {
 	return s, nil
 }
 
+func parseThreshold(val string) (int, error) {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if i < 1 {
+		return 0, fmt.Errorf("threshold must be at least 1, got %d", i)
+	}
+	return i, nil
+}
+
+func parseMaxAnswers(val string) (int, error) {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("maximum answers can't be negative, got %d", i)
+	}
+	return i, nil
+}
+
+// parseAlias returns the fqdn of an alias, names without a trailing dot are
+// relative to the domain. Aliases can't shadow the names watchdns generates
+func parseAlias(val, domain string) (string, error) {
+	name := strings.ToLower(val)
+	if !strings.HasSuffix(name, ".") {
+		name += "." + domain
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("invalid name '%s'", name)
+	}
+	if !dns.IsSubDomain(domain, name) || dns.CountLabel(name) == dns.CountLabel(domain) {
+		return "", fmt.Errorf("'%s' is not a name under %s", name, domain)
+	}
+	if dns.IsSubDomain("service."+domain, name) || dns.IsSubDomain("machine."+domain, name) || strings.HasPrefix(name, "_") {
+		return "", fmt.Errorf("'%s' would shadow names generated by watchdns", name)
+	}
+	return name, nil
+}
+
+// parseBackup accepts a boolean (true being tier 1) or a tier number
+func parseBackup(val string) (int, error) {
+	if b, err := strconv.ParseBool(val); err == nil {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("backup tier can't be negative, got %d", i)
+	}
+	return i, nil
+}
+
 func systemdUnescape(escaped string) string {
 	escaped = strings.Replace(escaped, "-", "/", -1)
 	var out bytes.Buffer
@@ -162,9 +241,13 @@ func (vars *UnitVars) ServiceOption(defaults RegistryOptions, opts []*unit.UnitO
 	o.Name = vars.ExpandValue("%P")
 	o.Tags = make([]string, 0, 4)
 	o.SrvOptions = make([]*SrvOption, 0, 2)
-	o.CheckHttp = make([]*url.URL, 0, 8)
+	o.CheckHttp = make([]*HttpCheck, 0, 8)
 	o.CheckTcp = make([]*net.TCPAddr, 0, 5)
 	o.CheckInterval = defaults.CheckInterval
+	o.CheckTimeout = defaults.CheckTimeout
+	o.HealthyThreshold = defaults.HealthyThreshold
+	o.UnhealthyThreshold = defaults.UnhealthyThreshold
+	o.MaxAnswers = defaults.MaxAnswers
 	if vars.InstanceName != "" {
 		o.Tags = append(o.Tags, "i-"+vars.ExpandValue("%I"))
 	}
@@ -187,6 +270,48 @@ func (vars *UnitVars) ServiceOption(defaults RegistryOptions, opts []*unit.UnitO
 				continue
 			}
 			o.CheckTimeout = i
+		case "HealthyThreshold":
+			i, err := parseThreshold(v.Value)
+			if err != nil {
+				log.Warnf("Could not parse HealthyThreshold value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.HealthyThreshold = i
+		case "UnhealthyThreshold":
+			i, err := parseThreshold(v.Value)
+			if err != nil {
+				log.Warnf("Could not parse UnhealthyThreshold value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.UnhealthyThreshold = i
+		case "Backup":
+			i, err := parseBackup(v.Value)
+			if err != nil {
+				log.Warnf("Could not parse Backup value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.Backup = i
+		case "MaxAnswers":
+			i, err := parseMaxAnswers(v.Value)
+			if err != nil {
+				log.Warnf("Could not parse MaxAnswers value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.MaxAnswers = i
+		case "Alias":
+			alias, err := parseAlias(vars.ExpandValue(v.Value), defaults.Domain)
+			if err != nil {
+				log.Warnf("Could not parse Alias value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.Aliases = append(o.Aliases, alias)
+		case "Txt":
+			txt := vars.ExpandValue(v.Value)
+			if len(txt) > 255 {
+				log.Warnf("Txt value '%s' in unit %s is longer than 255 bytes\n", v.Value, vars.UnitName)
+				continue
+			}
+			o.Txt = append(o.Txt, txt)
 		case "Name":
 			o.Name = vars.ExpandValue(v.Value)
 		case "Tag":
@@ -199,12 +324,47 @@ func (vars *UnitVars) ServiceOption(defaults RegistryOptions, opts []*unit.UnitO
 			}
 			o.SrvOptions = append(o.SrvOptions, srv)
 		case "CheckHttp":
-			u, err := url.Parse(vars.ExpandValue(v.Value))
+			c, err := parseHttpCheck(vars.ExpandValue(v.Value))
 			if err != nil {
 				log.Warnf("Could not parse CheckHttp value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
 				continue
 			}
-			o.CheckHttp = append(o.CheckHttp, u)
+			o.CheckHttp = append(o.CheckHttp, c)
+		case "CheckExec":
+			c, err := parseExecCheck(vars.ExpandValue(v.Value))
+			if err != nil {
+				log.Warnf("Could not parse CheckExec value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.CheckExec = append(o.CheckExec, c)
+		case "CheckDns":
+			c, err := parseDnsCheck(vars.ExpandValue(v.Value))
+			if err != nil {
+				log.Warnf("Could not parse CheckDns value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.CheckDns = append(o.CheckDns, c)
+		case "CheckUdp":
+			c, err := parseUdpCheck(vars.ExpandValue(v.Value))
+			if err != nil {
+				log.Warnf("Could not parse CheckUdp value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.CheckUdp = append(o.CheckUdp, c)
+		case "CheckGrpc":
+			c, err := parseGrpcCheck(vars.ExpandValue(v.Value))
+			if err != nil {
+				log.Warnf("Could not parse CheckGrpc value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.CheckGrpc = append(o.CheckGrpc, c)
+		case "CheckTls":
+			c, err := parseTlsCheck(vars.ExpandValue(v.Value))
+			if err != nil {
+				log.Warnf("Could not parse CheckTls value '%s' in unit %s: %s\n", v.Value, vars.UnitName, err.Error())
+				continue
+			}
+			o.CheckTls = append(o.CheckTls, c)
 		case "CheckTcp":
 			addr, err := net.ResolveTCPAddr("tcp", vars.ExpandValue(v.Value))
 			if err != nil {
@@ -216,5 +376,11 @@ func (vars *UnitVars) ServiceOption(defaults RegistryOptions, opts []*unit.UnitO
 			log.Warnf("Skipping unknown field '%s' in unit %s\n", v.Name, vars.UnitName)
 		}
 	}
+	//a check still running when the next round is due would hold it up, this
+	//applies to the global timeout too when the unit shortens the interval
+	if o.CheckInterval > 0 && o.CheckTimeout >= o.CheckInterval {
+		log.Warnf("CheckTimeout %s is not shorter than CheckInterval %s in unit %s, using %s\n", o.CheckTimeout, o.CheckInterval, vars.UnitName, o.CheckInterval/2)
+		o.CheckTimeout = o.CheckInterval / 2
+	}
 	return o
 }
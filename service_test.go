@@ -1,8 +1,11 @@
 package main
 
 import (
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseSrvOption(t *testing.T) {
@@ -73,3 +76,92 @@ func TestUnitVars_ExpandValue(t *testing.T) {
 	assert.Equal(t, "example", vars.ExpandValue("%p"))
 	assert.Equal(t, "example@bar.service", vars.ExpandValue("%n"))
 }
+
+func TestUnitVars_ServiceOption_Thresholds(t *testing.T) {
+	vars := &UnitVars{UnitName: "example.service", PrefixName: "example"}
+	defaults := RegistryOptions{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	o := vars.ServiceOption(defaults, nil)
+	assert.Equal(t, 2, o.HealthyThreshold)
+	assert.Equal(t, 3, o.UnhealthyThreshold)
+
+	o = vars.ServiceOption(defaults, []*unit.UnitOption{
+		{Section: "X-Watchdns", Name: "HealthyThreshold", Value: "5"},
+		{Section: "X-Watchdns", Name: "UnhealthyThreshold", Value: "0"},
+	})
+	assert.Equal(t, 5, o.HealthyThreshold)
+	assert.Equal(t, 3, o.UnhealthyThreshold, "invalid values keep the default")
+}
+
+func TestUnitVars_ServiceOption_CheckTimeout(t *testing.T) {
+	vars := &UnitVars{UnitName: "example.service", PrefixName: "example"}
+	defaults := RegistryOptions{CheckInterval: 5 * time.Second, CheckTimeout: 3 * time.Second}
+	o := vars.ServiceOption(defaults, nil)
+	assert.Equal(t, 3*time.Second, o.CheckTimeout, "defaults to the global timeout")
+
+	o = vars.ServiceOption(defaults, []*unit.UnitOption{{Section: "X-Watchdns", Name: "CheckTimeout", Value: "1s"}})
+	assert.Equal(t, time.Second, o.CheckTimeout)
+
+	o = vars.ServiceOption(defaults, []*unit.UnitOption{{Section: "X-Watchdns", Name: "CheckInterval", Value: "2s"}, {Section: "X-Watchdns", Name: "CheckTimeout", Value: "2s"}})
+	assert.Equal(t, time.Second, o.CheckTimeout, "timeouts must be shorter than the interval")
+
+	o = vars.ServiceOption(defaults, []*unit.UnitOption{{Section: "X-Watchdns", Name: "CheckInterval", Value: "2s"}})
+	assert.Equal(t, time.Second, o.CheckTimeout, "the global timeout is clamped as well")
+
+	o = vars.ServiceOption(RegistryOptions{CheckTimeout: 3 * time.Second}, []*unit.UnitOption{{Section: "X-Watchdns", Name: "CheckTimeout", Value: "1s"}})
+	assert.Equal(t, time.Second, o.CheckTimeout, "without an interval there is nothing to clamp to")
+}
+
+func TestUnitVars_ServiceOption_CheckExec(t *testing.T) {
+	vars := &UnitVars{UnitName: "example.service", PrefixName: "example", HostName: "10.0.0.1"}
+	o := vars.ServiceOption(RegistryOptions{}, []*unit.UnitOption{
+		{Section: "X-Watchdns", Name: "CheckExec", Value: `/bin/check %H "%n ok"`},
+		{Section: "X-Watchdns", Name: "CheckExec", Value: `  `},
+	})
+	if assert.Len(t, o.CheckExec, 1) {
+		assert.Equal(t, []string{"/bin/check", "10.0.0.1", "example.service ok"}, o.CheckExec[0].Args)
+	}
+}
+
+func TestUnitVars_ServiceOption_Txt(t *testing.T) {
+	vars := &UnitVars{UnitName: "example@1.service", PrefixName: "example", InstanceName: "1"}
+	o := vars.ServiceOption(RegistryOptions{}, []*unit.UnitOption{
+		{Section: "X-Watchdns", Name: "Txt", Value: "instance=%i"},
+		{Section: "X-Watchdns", Name: "Txt", Value: "path=/api"},
+		{Section: "X-Watchdns", Name: "Txt", Value: strings.Repeat("x", 256)},
+	})
+	assert.Equal(t, []string{"instance=1", "path=/api"}, o.Txt)
+}
+
+func TestParseAlias(t *testing.T) {
+	for val, name := range map[string]string{"api": "api.watchdns.", "API.v2": "api.v2.watchdns.", "api.watchdns.": "api.watchdns."} {
+		alias, err := parseAlias(val, "watchdns.")
+		assert.NoError(t, err, val)
+		assert.Equal(t, name, alias, val)
+	}
+	for _, val := range []string{"api.example.com.", "watchdns.", "web.service", "m-1.machine.watchdns.", "_http._tcp", "a..b"} {
+		_, err := parseAlias(val, "watchdns.")
+		assert.Error(t, err, val)
+	}
+}
+
+func TestParseBackup(t *testing.T) {
+	for val, tier := range map[string]int{"true": 1, "false": 0, "0": 0, "2": 2} {
+		i, err := parseBackup(val)
+		assert.NoError(t, err, val)
+		assert.Equal(t, tier, i, val)
+	}
+	_, err := parseBackup("-1")
+	assert.Error(t, err)
+	_, err = parseBackup("sometimes")
+	assert.Error(t, err)
+}
+
+func TestParseMaxAnswers(t *testing.T) {
+	i, err := parseMaxAnswers("5")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, i)
+	_, err = parseMaxAnswers("-1")
+	assert.Error(t, err)
+	_, err = parseMaxAnswers("all")
+	assert.Error(t, err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+)
+
+// lookupSnapshot is an immutable view of everything needed to answer
+// queries. The main loop builds a new one whenever something changes and
+// swaps it in atomically, so lookups never wait on the loop. Answers are
+// shared between readers and must not be modified.
+type lookupSnapshot struct {
+	a     map[string][]AnswerA
+	srv   map[string][]AnswerSrv
+	names map[string]bool
+	max   map[string]int
+	ptr   map[string][]AnswerPtr
+	txt   map[string][]AnswerTxt
+	cname map[string]AnswerCname
+}
+
+// publish builds a new snapshot from the current state, it must only be
+// called from the main loop (or before it is started)
+func (r *ServiceRegistry) publish() {
+	s := new(lookupSnapshot)
+	s.a = make(map[string][]AnswerA, len(r.lookup)+len(r.machineLookup))
+	s.srv = make(map[string][]AnswerSrv, len(r.lookup))
+	s.names = make(map[string]bool, len(r.names))
+	s.max = make(map[string]int)
+	s.ptr = make(map[string][]AnswerPtr, len(r.machineIps))
+	s.txt = make(map[string][]AnswerTxt, len(r.lookup))
+	s.cname = make(map[string]AnswerCname, len(r.aliases))
+	//names are matched case-insensitively, so everything is keyed in lower case
+	for name, addr := range r.machineLookup {
+		if addr != nil {
+			key := strings.ToLower(name)
+			s.a[key] = append(s.a[key], AnswerA{addr, r.Options.FleetInterval, 0, 0})
+		}
+	}
+	for name, entries := range r.lookup {
+		key := strings.ToLower(name)
+		tier := activeTier(entries)
+		for _, e := range entries {
+			if e.MaxAnswers > 0 && (s.max[key] == 0 || e.MaxAnswers < s.max[key]) {
+				s.max[key] = e.MaxAnswers
+			}
+			//TXT records describe every unit, healthy or not
+			if !strings.HasPrefix(name, "_") {
+				s.txt[key] = append(s.txt[key], e.txtAnswers()...)
+			}
+			if !e.serving() || e.Backup != tier {
+				continue
+			}
+			if strings.HasPrefix(name, "_") {
+				for _, o := range e.SrvOptions {
+					if name == "_"+o.Service+"._"+o.Protocol+"."+r.Options.Domain {
+						s.srv[key] = append(s.srv[key], AnswerSrv{e.Hostname, e.ServerAddress, *o, e.CheckInterval})
+					}
+				}
+			} else {
+				priority, weight := e.addressWeight()
+				s.a[key] = append(s.a[key], AnswerA{e.ServerAddress, e.CheckInterval, priority, weight})
+			}
+		}
+	}
+	for name, n := range r.names {
+		if n > 0 {
+			s.names[name] = true
+		}
+	}
+	for name, entries := range r.aliases {
+		//the lowest unit name keeps an alias, whatever order the units came in
+		owner := entries[0]
+		for _, e := range entries[1:] {
+			if e.UnitName < owner.UnitName {
+				owner = e
+			}
+		}
+		s.cname[name] = AnswerCname{owner.Name + ".service." + r.Options.Domain, owner.CheckInterval}
+	}
+	r.publishPtr(s)
+	r.snapshot.Store(s)
+	r.dirty = false
+}
+
+// publishPtr maps the reverse names of machine addresses back to the
+// machines and, with ReverseServices, to the units serving on them
+func (r *ServiceRegistry) publishPtr(s *lookupSnapshot) {
+	for id, publicIp := range r.machineIps {
+		ip := net.ParseIP(publicIp)
+		if ip == nil {
+			continue
+		}
+		rev, _ := dns.ReverseAddr(ip.String())
+		s.ptr[rev] = append(s.ptr[rev], AnswerPtr{"m-" + id + ".machine." + r.Options.Domain, r.Options.FleetInterval})
+	}
+	if r.Options.ReverseServices {
+		for _, e := range r.units {
+			if !e.indexed || !e.serving() {
+				continue
+			}
+			rev, _ := dns.ReverseAddr(e.ServerAddress.String())
+			s.ptr[rev] = append(s.ptr[rev], AnswerPtr{e.instanceName(r.Options.Domain), e.CheckInterval})
+		}
+	}
+	for rev, ans := range s.ptr {
+		//machines come first, everything else in a stable order
+		sort.SliceStable(ans, func(i, j int) bool {
+			mi := strings.HasSuffix(ans[i].Target, ".machine."+r.Options.Domain)
+			mj := strings.HasSuffix(ans[j].Target, ".machine."+r.Options.Domain)
+			if mi != mj {
+				return mi
+			}
+			return ans[i].Target < ans[j].Target
+		})
+		//units of the same service on one machine share a name
+		out := ans[:0]
+		for i, a := range ans {
+			if i == 0 || a.Target != ans[i-1].Target {
+				out = append(out, a)
+			}
+		}
+		s.ptr[rev] = out
+	}
+}
+
+// txtAnswers returns the unit's own TXT record, if it has one, followed by
+// the built-in record describing the unit and its health
+func (e *ServiceEntry) txtAnswers() []AnswerTxt {
+	health := "offline"
+	if e.serving() {
+		health = "online"
+	}
+	builtin := AnswerTxt{[]string{"unit=" + e.UnitName, "machine=" + e.MachineId, "health=" + health}, e.CheckInterval}
+	if len(e.Txt) == 0 {
+		return []AnswerTxt{builtin}
+	}
+	return []AnswerTxt{{e.Txt, e.CheckInterval}, builtin}
+}
+
+// instanceName is the most specific name a unit answers to, its first
+// tag (the instance, if it has one) under the service name
+func (e *ServiceEntry) instanceName(domain string) string {
+	if len(e.Tags) > 0 {
+		return e.Tags[0] + "." + e.Name + ".service." + domain
+	}
+	return e.Name + ".service." + domain
+}
+
+func (e *ServiceEntry) serving() bool {
+	return e.Running && e.Online && e.ServerAddress != nil
+}
+
+// activeTier returns the lowest backup tier with a unit able to serve,
+// backups are only answered with once every primary is down
+func activeTier(entries []*ServiceEntry) int {
+	tier := -1
+	for _, e := range entries {
+		if e.serving() && (tier == -1 || e.Backup < tier) {
+			tier = e.Backup
+		}
+	}
+	return tier
+}
+
+func (r *ServiceRegistry) currentSnapshot() *lookupSnapshot {
+	s, _ := r.snapshot.Load().(*lookupSnapshot)
+	if s == nil {
+		return new(lookupSnapshot)
+	}
+	return s
+}
+
+// LookupA returns the addresses of every healthy unit answering to name
+func (r *ServiceRegistry) LookupA(name string) []AnswerA {
+	return r.currentSnapshot().a[strings.ToLower(name)]
+}
+
+// LookupSrv returns the SRV targets of every healthy unit for the service
+func (r *ServiceRegistry) LookupSrv(name, service, protocol string) []AnswerSrv {
+	ans := r.currentSnapshot().srv[strings.ToLower(name)]
+	for i, a := range ans {
+		if !strings.EqualFold(a.Service, service) || !strings.EqualFold(a.Protocol, protocol) {
+			//only copy in the unusual case that something needs filtering
+			filtered := append([]AnswerSrv{}, ans[:i]...)
+			for _, a := range ans[i+1:] {
+				if strings.EqualFold(a.Service, service) && strings.EqualFold(a.Protocol, protocol) {
+					filtered = append(filtered, a)
+				}
+			}
+			return filtered
+		}
+	}
+	return ans
+}
+
+// LookupMaxAnswers returns the most addresses to answer name with, 0 for all
+func (r *ServiceRegistry) LookupMaxAnswers(name string) int {
+	return r.currentSnapshot().max[strings.ToLower(name)]
+}
+
+// LookupPtr returns the names for the address a reverse name stands for
+func (r *ServiceRegistry) LookupPtr(name string) []AnswerPtr {
+	return r.currentSnapshot().ptr[strings.ToLower(name)]
+}
+
+// LookupTxt returns the TXT records of every unit answering to name
+func (r *ServiceRegistry) LookupTxt(name string) []AnswerTxt {
+	return r.currentSnapshot().txt[strings.ToLower(name)]
+}
+
+// LookupAlias returns the name an alias points to, the target is empty
+// when name isn't an alias
+func (r *ServiceRegistry) LookupAlias(name string) AnswerCname {
+	return r.currentSnapshot().cname[strings.ToLower(name)]
+}
+
+// LookupName reports whether name exists in the zone, regardless of
+// the health of the units behind it
+func (r *ServiceRegistry) LookupName(name string) bool {
+	return r.currentSnapshot().names[strings.ToLower(name)]
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func benchRegistry(n int) *ServiceRegistry {
+	entries := make([]*ServiceEntry, 0, n)
+	for i := 0; i < n; i++ {
+		e := testEntry(fmt.Sprintf("svc%d", i%10), fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), true)
+		e.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80}}
+		entries = append(entries, e)
+	}
+	return newTestRegistry(entries...)
+}
+
+func TestSnapshot_Publish(t *testing.T) {
+	e := testEntry("web", "10.0.0.1", true)
+	r := newTestRegistry(e)
+	assert.Len(t, r.LookupA("web.service.watchdns."), 1)
+
+	//changes are only visible once published
+	e.Online = false
+	assert.Len(t, r.LookupA("web.service.watchdns."), 1)
+	r.publish()
+	assert.Len(t, r.LookupA("web.service.watchdns."), 0)
+	assert.True(t, r.LookupName("WEB.service.watchdns."))
+	assert.Nil(t, new(ServiceRegistry).LookupA("web.service.watchdns."))
+}
+
+func TestSnapshot_Backup(t *testing.T) {
+	primary := testEntry("web", "10.0.0.1", true)
+	backup := testEntry("web", "10.0.0.2", true)
+	backup.Backup = 1
+	last := testEntry("web", "10.0.0.3", true)
+	last.Backup = 2
+	for _, e := range []*ServiceEntry{primary, backup, last} {
+		e.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80}}
+	}
+	r := newTestRegistry(primary, backup, last)
+	ips := func() []string {
+		var s []string
+		for _, a := range r.LookupA("web.service.watchdns.") {
+			s = append(s, a.Server.String())
+		}
+		for _, a := range r.LookupSrv("_http._tcp.watchdns.", "http", "tcp") {
+			s = append(s, "srv:"+a.TargetIP.String())
+		}
+		return s
+	}
+	assert.Equal(t, []string{"10.0.0.1", "srv:10.0.0.1"}, ips())
+
+	primary.Online = false
+	r.publish()
+	assert.Equal(t, []string{"10.0.0.2", "srv:10.0.0.2"}, ips())
+
+	backup.Running = false
+	r.publish()
+	assert.Equal(t, []string{"10.0.0.3", "srv:10.0.0.3"}, ips())
+
+	primary.Online = true
+	r.publish()
+	assert.Equal(t, []string{"10.0.0.1", "srv:10.0.0.1"}, ips(), "primaries take over again")
+}
+
+func TestSnapshot_ConcurrentReads(t *testing.T) {
+	r := benchRegistry(100)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.LookupA("svc1.service.watchdns.")
+				r.LookupSrv("_http._tcp.watchdns.", "http", "tcp")
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		r.publish()
+	}
+	wg.Wait()
+}
+
+func BenchmarkLookupA(b *testing.B) {
+	r := benchRegistry(500)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.LookupA("svc1.service.watchdns.")
+		}
+	})
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	d := newDnsServer(benchRegistry(500), nil)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			query(d, "svc1.service.watchdns.", dns.TypeA)
+		}
+	})
+}
+
+// BenchmarkServeDNS_Publishing keeps the registry busy publishing new
+// snapshots, which queries should not have to wait for
+func BenchmarkServeDNS_Publishing(b *testing.B) {
+	r := benchRegistry(500)
+	d := newDnsServer(r, nil)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(done)
+				return
+			default:
+				r.publish()
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			query(d, "svc1.service.watchdns.", dns.TypeA)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
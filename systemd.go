@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/coreos/fleet/Godeps/_workspace/src/github.com/coreos/go-systemd/unit"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// SystemdBackend discovers units from the local systemd through systemctl,
+// for single hosts that don't run fleet. Only units with an [X-Watchdns]
+// section in their unit file (or one of its drop-ins) are reported.
+type SystemdBackend struct {
+	MachineId string
+	Address   string
+	// run executes systemctl, replaced in tests
+	run   func(args ...string) ([]byte, error)
+	paths map[string][]string
+}
+
+// NewSystemdBackend uses the local machine ID, and the first global unicast
+// address of the host when address is empty
+func NewSystemdBackend(address string) (*SystemdBackend, error) {
+	id, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		address, err = hostAddress()
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Debugln("Using host address:", address)
+	return &SystemdBackend{strings.TrimSpace(string(id)), address, systemctl, make(map[string][]string)}, nil
+}
+
+func systemctl(args ...string) ([]byte, error) {
+	return exec.Command("systemctl", args...).Output()
+}
+
+func hostAddress() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("no global unicast address found, set HostAddress")
+}
+
+// parseSystemctlShow splits `systemctl show` output into one map of
+// properties per unit
+func parseSystemctlShow(out []byte) []map[string]string {
+	units := make([]map[string]string, 0, 10)
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(props) > 0 {
+				units = append(units, props)
+				props = make(map[string]string)
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i != -1 {
+			props[line[:i]] = line[i+1:]
+		}
+	}
+	if len(props) > 0 {
+		units = append(units, props)
+	}
+	return units
+}
+
+func (s *SystemdBackend) Machines() ([]*Machine, error) {
+	return []*Machine{{s.MachineId, s.Address}}, nil
+}
+
+// UnitStates lists every loaded service, the hash covers the unit file
+// and its drop-ins so changes on disk cause them to be parsed again
+func (s *SystemdBackend) UnitStates() ([]*UnitState, error) {
+	out, err := s.run("list-units", "--type=service", "--all", "--no-legend", "--plain")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 50)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	if len(names) == 0 {
+		return []*UnitState{}, nil
+	}
+	out, err = s.run(append([]string{"show", "--property=Id,ActiveState,FragmentPath,DropInPaths"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	s.paths = make(map[string][]string, len(names))
+	states := make([]*UnitState, 0, len(names))
+	for _, props := range parseSystemctlShow(out) {
+		paths := append([]string{props["FragmentPath"]}, strings.Fields(props["DropInPaths"])...)
+		data := readUnitFiles(paths)
+		if !bytes.Contains(data, []byte("[X-Watchdns]")) {
+			continue
+		}
+		sum := sha1.Sum(data)
+		s.paths[props["Id"]] = paths
+		states = append(states, &UnitState{props["Id"], s.MachineId, hex.EncodeToString(sum[:]), props["ActiveState"]})
+	}
+	return states, nil
+}
+
+// readUnitFiles concatenates a unit file with its drop-ins,
+// files that can't be read are skipped
+func readUnitFiles(paths []string) []byte {
+	var buf bytes.Buffer
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			log.Debugf("Could not read unit file %s: %s\n", p, err.Error())
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (s *SystemdBackend) UnitOptions(unitName string) ([]*unit.UnitOption, error) {
+	paths := s.paths[unitName]
+	if paths == nil {
+		return nil, nil
+	}
+	return unit.Deserialize(bytes.NewReader(readUnitFiles(paths)))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSystemctlShow(t *testing.T) {
+	out := []byte("Id=web@1.service\nActiveState=active\nFragmentPath=/etc/systemd/system/web@.service\n\nId=db.service\nActiveState=failed\nDropInPaths=\n")
+	units := parseSystemctlShow(out)
+	if assert.Len(t, units, 2) {
+		assert.Equal(t, "web@1.service", units[0]["Id"])
+		assert.Equal(t, "/etc/systemd/system/web@.service", units[0]["FragmentPath"])
+		assert.Equal(t, "failed", units[1]["ActiveState"])
+		assert.Equal(t, "", units[1]["DropInPaths"])
+	}
+}
+
+func TestSystemdBackend(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "web@.service"), "[Service]\nExecStart=/usr/bin/web\n")
+	writeFile(t, filepath.Join(dir, "watchdns.conf"), "[X-Watchdns]\nSrv=http:tcp:80\n")
+	writeFile(t, filepath.Join(dir, "sshd.service"), "[Service]\nExecStart=/usr/sbin/sshd\n")
+
+	s := &SystemdBackend{MachineId: "abcdef0123456789", Address: "10.0.0.5", paths: make(map[string][]string)}
+	s.run = func(args ...string) ([]byte, error) {
+		if args[0] == "list-units" {
+			return []byte("web@1.service loaded active running Web\nweb@2.service loaded failed failed Web\nsshd.service loaded active running SSH\n"), nil
+		}
+		assert.Equal(t, []string{"web@1.service", "web@2.service", "sshd.service"}, args[2:])
+		return []byte("Id=web@1.service\nActiveState=active\nFragmentPath=" + filepath.Join(dir, "web@.service") + "\nDropInPaths=" + filepath.Join(dir, "watchdns.conf") + "\n\n" +
+			"Id=web@2.service\nActiveState=failed\nFragmentPath=" + filepath.Join(dir, "web@.service") + "\nDropInPaths=" + filepath.Join(dir, "watchdns.conf") + "\n\n" +
+			"Id=sshd.service\nActiveState=active\nFragmentPath=" + filepath.Join(dir, "sshd.service") + "\nDropInPaths=\n"), nil
+	}
+
+	ms, err := s.Machines()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Machine{{"abcdef0123456789", "10.0.0.5"}}, ms)
+
+	//only units configured for watchdns are reported
+	states, err := s.UnitStates()
+	assert.NoError(t, err)
+	if assert.Len(t, states, 2) {
+		assert.Equal(t, &UnitState{"web@1.service", "abcdef0123456789", states[0].UnitHash, "active"}, states[0])
+		assert.Equal(t, "failed", states[1].ActiveState)
+	}
+
+	opts, err := s.UnitOptions("web@1.service")
+	assert.NoError(t, err)
+	assert.Len(t, opts, 2)
+	opts, err = s.UnitOptions("sshd.service")
+	assert.NoError(t, err)
+	assert.Nil(t, opts)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultTlsExpiry is how close to expiring a certificate may get before
+// the check fails, when the expiry option isn't set
+const defaultTlsExpiry = 7 * 24 * time.Hour
+
+// TlsCheck is a parsed CheckTls value, in the format:
+//
+//	<host>:<port> [option=value]...
+//
+// Options are server-name (the SNI to send and verify against, the host by
+// default), tls-ca (verify against a custom CA) and expiry (fail when the
+// leaf certificate expires within this duration, 168h by default).
+type TlsCheck struct {
+	Address string
+	Expiry  time.Duration
+	TLS     *tls.Config
+}
+
+func parseTlsCheck(val string) (*TlsCheck, error) {
+	fields, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing address")
+	}
+	host, _, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	c := &TlsCheck{fields[0], defaultTlsExpiry, nil}
+	serverName, caFile := host, ""
+	for _, f := range fields[1:] {
+		name, value, err := splitOption(f)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "server-name":
+			serverName = value
+		case "tls-ca":
+			caFile = value
+		case "expiry":
+			c.Expiry, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+	}
+	c.TLS, err = loadTlsConfig(false, caFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	c.TLS.ServerName = serverName
+	return c, nil
+}
+
+func (c *TlsCheck) String() string {
+	return fmt.Sprintf("%s (%s)", c.Address, c.TLS.ServerName)
+}
+
+// Check completes a handshake, verifying the chain against the server name,
+// and makes sure the leaf certificate isn't about to expire
+func (c *TlsCheck) Check(timeout time.Duration) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", c.Address, c.TLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	if expires := certs[0].NotAfter; time.Now().Add(c.Expiry).After(expires) {
+		return fmt.Errorf("certificate for %s expires at %s", c.TLS.ServerName, expires.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTlsServer accepts connections and completes handshakes with cert
+func startTlsServer(t *testing.T, cert tls.Certificate) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestParseTlsCheck(t *testing.T) {
+	c, err := parseTlsCheck("10.0.0.1:443")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", c.TLS.ServerName)
+	assert.Equal(t, defaultTlsExpiry, c.Expiry)
+
+	c, err = parseTlsCheck("10.0.0.1:443 server-name=example.com expiry=24h")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", c.TLS.ServerName)
+	assert.Equal(t, 24*time.Hour, c.Expiry)
+	assert.Equal(t, "10.0.0.1:443 (example.com)", c.String())
+
+	for _, v := range []string{"", "10.0.0.1", "10.0.0.1:443 expiry=soon", "10.0.0.1:443 tls-ca=/nonexistent", "10.0.0.1:443 nope=1"} {
+		_, err = parseTlsCheck(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestTlsCheck_Check(t *testing.T) {
+	cert := selfSignedCert(t, x509.ExtKeyUsageServerAuth, time.Now().Add(30*24*time.Hour))
+	addr := startTlsServer(t, cert)
+	ca := writeCA(t, cert.Leaf)
+
+	c, _ := parseTlsCheck(addr)
+	assert.Error(t, c.Check(time.Second), "self-signed certificates don't verify")
+	c, _ = parseTlsCheck(addr + " tls-ca=" + ca)
+	assert.NoError(t, c.Check(time.Second))
+	c, _ = parseTlsCheck(addr + " tls-ca=" + ca + " server-name=localhost")
+	assert.NoError(t, c.Check(time.Second))
+	c, _ = parseTlsCheck(addr + " tls-ca=" + ca + " server-name=example.com")
+	assert.Error(t, c.Check(time.Second), "certificate isn't valid for the name")
+	c, _ = parseTlsCheck(addr + " tls-ca=" + ca + " expiry=720h1m")
+	assert.Error(t, c.Check(time.Second), "certificate expires within the window")
+}
+
+func TestTlsCheck_Expired(t *testing.T) {
+	cert := selfSignedCert(t, x509.ExtKeyUsageServerAuth, time.Now().Add(-time.Minute))
+	addr := startTlsServer(t, cert)
+
+	c, _ := parseTlsCheck(addr + " tls-ca=" + writeCA(t, cert.Leaf) + " expiry=0s")
+	assert.Error(t, c.Check(time.Second))
+}
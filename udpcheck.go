@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// udpUnreachableWait is how long a check without expect waits for an ICMP
+// port unreachable before taking the silence as healthy
+const udpUnreachableWait = 200 * time.Millisecond
+
+// DnsCheck is a parsed CheckDns value, in the format:
+//
+//	<host>[:port] [option=value]...
+//
+// Options are name (. by default), type (NS by default), rcode (accepted
+// rcodes, comma separated, NOERROR by default) and tcp. The port defaults to 53.
+type DnsCheck struct {
+	Address string
+	Name    string
+	Qtype   uint16
+	Rcodes  []int
+	TCP     bool
+}
+
+// UdpCheck is a parsed CheckUdp value, in the format:
+//
+//	<host>:<port> [option=value]...
+//
+// Options are send (the payload), send-hex, expect (a substring the reply
+// must contain) and expect-hex. Without expect any reply, or no reply at all
+// within a short wait, is healthy; only an ICMP port unreachable fails the check.
+type UdpCheck struct {
+	Address string
+	Send    []byte
+	Expect  []byte
+}
+
+// splitOption splits a check option in the format <name>=<value>
+func splitOption(f string) (string, string, error) {
+	i := strings.IndexByte(f, '=')
+	if i == -1 {
+		return "", "", fmt.Errorf("option '%s' should be in format <name>=<value>", f)
+	}
+	return f[:i], f[i+1:], nil
+}
+
+func parseDnsCheck(val string) (*DnsCheck, error) {
+	fields, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing address")
+	}
+	c := &DnsCheck{fields[0], ".", dns.TypeNS, []int{dns.RcodeSuccess}, false}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(strings.Trim(c.Address, "[]"), "53")
+	}
+	for _, f := range fields[1:] {
+		name, value, err := splitOption(f)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "name":
+			c.Name = dns.Fqdn(value)
+		case "type":
+			t, ok := dns.StringToType[strings.ToUpper(value)]
+			if !ok {
+				return nil, fmt.Errorf("unknown record type '%s'", value)
+			}
+			c.Qtype = t
+		case "rcode":
+			c.Rcodes = c.Rcodes[:0]
+			for _, s := range strings.Split(value, ",") {
+				rc, ok := dns.StringToRcode[strings.ToUpper(strings.TrimSpace(s))]
+				if !ok {
+					return nil, fmt.Errorf("unknown rcode '%s'", s)
+				}
+				c.Rcodes = append(c.Rcodes, rc)
+			}
+		case "tcp":
+			c.TCP, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+	}
+	return c, nil
+}
+
+func (c *DnsCheck) String() string {
+	return fmt.Sprintf("%s %s %s", c.Address, c.Name, dns.TypeToString[c.Qtype])
+}
+
+// Check sends the query and requires a response with one of the accepted rcodes
+func (c *DnsCheck) Check(timeout time.Duration) error {
+	client := &dns.Client{Net: "udp", Timeout: timeout}
+	if c.TCP {
+		client.Net = "tcp"
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(c.Name, c.Qtype)
+	resp, _, err := client.Exchange(m, c.Address)
+	if err != nil {
+		return err
+	}
+	if !resp.Response {
+		return errors.New("reply is not a response")
+	}
+	for _, rc := range c.Rcodes {
+		if resp.Rcode == rc {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[resp.Rcode])
+}
+
+func parseUdpCheck(val string) (*UdpCheck, error) {
+	fields, err := splitQuoted(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing address")
+	}
+	if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+		return nil, err
+	}
+	c := &UdpCheck{Address: fields[0]}
+	for _, f := range fields[1:] {
+		name, value, err := splitOption(f)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "send":
+			c.Send = []byte(value)
+		case "send-hex":
+			c.Send, err = hex.DecodeString(value)
+		case "expect":
+			c.Expect = []byte(value)
+		case "expect-hex":
+			c.Expect, err = hex.DecodeString(value)
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *UdpCheck) String() string {
+	return c.Address
+}
+
+// Check sends the payload and waits for a reply, if one is expected
+func (c *UdpCheck) Check(timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", c.Address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(c.Send); err != nil {
+		return err
+	}
+
+	if c.Expect == nil && timeout > udpUnreachableWait {
+		conn.SetReadDeadline(time.Now().Add(udpUnreachableWait))
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		//silence is fine when no reply is expected, an unreachable port is not
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && c.Expect == nil {
+			return nil
+		}
+		return err
+	}
+	if c.Expect != nil && !bytes.Contains(buf[:n], c.Expect) {
+		return errors.New("reply doesn't contain the expected data")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDnsCheck(t *testing.T) {
+	c, err := parseDnsCheck("10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, &DnsCheck{"10.0.0.1:53", ".", dns.TypeNS, []int{dns.RcodeSuccess}, false}, c)
+
+	c, err = parseDnsCheck("[::1]:5353 name=example.internal type=aaaa rcode=NOERROR,nxdomain tcp=true")
+	assert.NoError(t, err)
+	assert.Equal(t, &DnsCheck{"[::1]:5353", "example.internal.", dns.TypeAAAA, []int{dns.RcodeSuccess, dns.RcodeNameError}, true}, c)
+
+	for _, v := range []string{"", "10.0.0.1 type=BOGUS", "10.0.0.1 rcode=MAYBE", "10.0.0.1 port=53"} {
+		_, err = parseDnsCheck(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestDnsCheck_Check(t *testing.T) {
+	addr := startStubServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name != "example.internal." {
+			m.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(m)
+	})
+
+	c, _ := parseDnsCheck(addr + " name=example.internal type=A")
+	assert.NoError(t, c.Check(time.Second))
+	c.TCP = true
+	assert.NoError(t, c.Check(time.Second), "over tcp")
+
+	c, _ = parseDnsCheck(addr)
+	assert.Error(t, c.Check(time.Second), "REFUSED isn't accepted")
+	c, _ = parseDnsCheck(addr + " rcode=NOERROR,REFUSED")
+	assert.NoError(t, c.Check(time.Second))
+}
+
+func TestParseUdpCheck(t *testing.T) {
+	c, err := parseUdpCheck(`10.0.0.1:8125 send="a b" expect-hex=0001`)
+	assert.NoError(t, err)
+	assert.Equal(t, &UdpCheck{"10.0.0.1:8125", []byte("a b"), []byte{0, 1}}, c)
+
+	for _, v := range []string{"", "10.0.0.1", "10.0.0.1:1 send-hex=zz", "10.0.0.1:1 nope=1"} {
+		_, err = parseUdpCheck(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestUdpCheck_Check(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				pc.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+	addr := pc.LocalAddr().String()
+
+	c := &UdpCheck{addr, []byte("ping"), []byte("pong")}
+	assert.NoError(t, c.Check(time.Second))
+	c = &UdpCheck{addr, []byte("ping"), []byte("other")}
+	assert.Error(t, c.Check(time.Second), "unexpected reply")
+	c = &UdpCheck{addr, []byte("quiet"), []byte("pong")}
+	assert.Error(t, c.Check(100*time.Millisecond), "no reply")
+	c = &UdpCheck{addr, []byte("quiet"), nil}
+	assert.NoError(t, c.Check(100*time.Millisecond), "no reply expected")
+	start := time.Now()
+	assert.NoError(t, c.Check(5*time.Second), "no reply expected")
+	assert.True(t, time.Since(start) < time.Second, "silence doesn't wait out the timeout")
+
+	//a closed port is reported back as unreachable
+	closed, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+	c = &UdpCheck{closedAddr, []byte("ping"), nil}
+	assert.Error(t, c.Check(time.Second))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// weightedOrder returns an ordering of n records following RFC 2782: lower
+// priorities always come first, and within a priority each position is
+// picked from the records left with a random number between 0 and the sum of
+// their weights, inclusive. Records with a weight of 0 are arranged first so
+// they have a small chance of being picked, which is all they get.
+func weightedOrder(n int, priority, weight func(i int) uint16) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return priority(idx[a]) < priority(idx[b]) })
+	for start := 0; start < n; {
+		end := start + 1
+		for end < n && priority(idx[end]) == priority(idx[start]) {
+			end++
+		}
+		group := idx[start:end]
+		rand.Shuffle(len(group), func(a, b int) { group[a], group[b] = group[b], group[a] })
+		sort.SliceStable(group, func(a, b int) bool { return weight(group[a]) == 0 && weight(group[b]) != 0 })
+		total := 0
+		for _, i := range group {
+			total += int(weight(i))
+		}
+		for k := range group {
+			//the first record whose running sum reaches the number is picked
+			r := rand.Intn(total + 1)
+			pick, sum := k, int(weight(group[k]))
+			for sum < r {
+				pick++
+				sum += int(weight(group[pick]))
+			}
+			total -= int(weight(group[pick]))
+			//the rest stay in order, so the unweighted ones stay in front
+			picked := group[pick]
+			copy(group[k+1:pick+1], group[k:pick])
+			group[k] = picked
+		}
+		start = end
+	}
+	return idx
+}
+
+// addressWeight returns the priority and weight the entry's addresses are
+// answered with, taken from its first Srv option as that is its main service.
+// Entries without one rank below every configured priority.
+func (e *ServiceEntry) addressWeight() (priority, weight uint16) {
+	if len(e.SrvOptions) == 0 {
+		return math.MaxUint16, 0
+	}
+	return e.SrvOptions[0].Priority, e.SrvOptions[0].Weight
+}
+
+// weightedA returns a weighted ordering of the answers, they come from a
+// snapshot so a copy is made instead of sorting in place
+func weightedA(ans []AnswerA) []AnswerA {
+	order := weightedOrder(len(ans), func(i int) uint16 { return ans[i].Priority }, func(i int) uint16 { return ans[i].Weight })
+	out := make([]AnswerA, len(ans))
+	for i, j := range order {
+		out[i] = ans[j]
+	}
+	return out
+}
+
+func weightedSrv(ans []AnswerSrv) []AnswerSrv {
+	order := weightedOrder(len(ans), func(i int) uint16 { return ans[i].Priority }, func(i int) uint16 { return ans[i].Weight })
+	out := make([]AnswerSrv, len(ans))
+	for i, j := range order {
+		out[i] = ans[j]
+	}
+	return out
+}
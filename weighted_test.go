@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestWeightedOrder(t *testing.T) {
+	priorities := []uint16{1, 0, 0, 1}
+	weights := []uint16{0, 1, 3, 5}
+	first := make(map[int]int)
+	for i := 0; i < 6000; i++ {
+		order := weightedOrder(4, func(i int) uint16 { return priorities[i] }, func(i int) uint16 { return weights[i] })
+		assert.ElementsMatch(t, []int{1, 2}, order[:2])
+		assert.ElementsMatch(t, []int{3, 0}, order[2:])
+		first[order[0]]++
+		first[order[2]+10]++
+	}
+	//the inclusive upper bound favours whichever weighted record is last
+	assert.InDelta(t, 4200, first[2], 250)
+	assert.InDelta(t, 1800, first[1], 250)
+	//the zero weight record is only picked first when the number is 0
+	assert.InDelta(t, 1000, first[10], 200)
+	assert.InDelta(t, 5000, first[13], 200)
+
+	//without weights every order is possible
+	first = make(map[int]int)
+	for i := 0; i < 300; i++ {
+		first[weightedOrder(3, func(int) uint16 { return 0 }, func(int) uint16 { return 0 })[0]]++
+	}
+	assert.Len(t, first, 3)
+}
+
+func TestDnsServer_Weighted(t *testing.T) {
+	primary := testEntry("web", "10.0.0.1", true)
+	primary.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80, Priority: 10, Weight: 1}, {Service: "admin", Protocol: "tcp", Port: 81, Priority: 0, Weight: 1}}
+	secondary := testEntry("web", "10.0.0.2", true)
+	secondary.SrvOptions = []*SrvOption{{Service: "http", Protocol: "tcp", Port: 80, Priority: 5, Weight: 1}}
+	bare := testEntry("web", "10.0.0.3", true)
+	//the first Srv option decides, not the most preferred one of another service
+	p, w := primary.addressWeight()
+	assert.Equal(t, []uint16{10, 1}, []uint16{p, w})
+	p, w = bare.addressWeight()
+	assert.Equal(t, []uint16{math.MaxUint16, 0}, []uint16{p, w})
+
+	r := newTestRegistry(bare, primary, secondary)
+	r.Options.RecordSort = "weighted"
+	d := newDnsServer(r, nil)
+	for i := 0; i < 10; i++ {
+		m := query(d, "web.service.watchdns.", dns.TypeA)
+		if assert.Len(t, m.Answer, 3) {
+			assert.Equal(t, "10.0.0.2", m.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, "10.0.0.1", m.Answer[1].(*dns.A).A.String())
+			assert.Equal(t, "10.0.0.3", m.Answer[2].(*dns.A).A.String())
+		}
+		m = query(d, "_http._tcp.watchdns.", dns.TypeSRV)
+		if assert.Len(t, m.Answer, 2) {
+			assert.Equal(t, uint16(5), m.Answer[0].(*dns.SRV).Priority)
+		}
+	}
+	//the snapshot is left alone
+	assert.Equal(t, "10.0.0.3", r.LookupA("web.service.watchdns.")[0].Server.String())
+}